@@ -2,9 +2,9 @@ package main
 
 import (
 	"log"
-	"net"
 	"os"
-	"strconv"
+
+	"z44-tunnel/common"
 )
 
 func main() {
@@ -16,6 +16,14 @@ func main() {
 		}
 	}()
 
+	// One-shot enrollment with a token instead of running the tunnel
+	if len(os.Args) > 1 && os.Args[1] == "enroll" {
+		if err := runEnroll(os.Args[2:]); err != nil {
+			log.Fatalf("❌ Enrollment failed: %v", err)
+		}
+		return
+	}
+
 	// Load configuration
 	cfg, err := LoadConfig("config.json")
 	if err != nil {
@@ -25,16 +33,38 @@ func main() {
 	// Build port map
 	portMap := BuildPortMap(cfg.Mappings)
 
+	// Resolve the endpoint for the selected transport
+	_, addr := cfg.Endpoint()
+
 	// Load TLS configuration
-	tlsConfig, err := LoadTLSConfig(cfg.ServerAddr)
+	tlsSource, err := LoadTLSConfig(cfg)
 	if err != nil {
 		log.Fatalf("Failed to load TLS configuration: %v", err)
 	}
+	log.Printf("🔐 TLS policy: %s", tlsSource.Settings())
+	if certs := tlsSource.Certs(); certs != nil {
+		go handleReloads(certs)
+	}
 
-	// Create tunnel address
-	addr := net.JoinHostPort(cfg.ServerAddr, strconv.Itoa(cfg.TunnelPort))
+	// Start optional metrics endpoint
+	if cfg.AdminAddr != "" {
+		go common.ServeAdmin(cfg.AdminAddr)
+	}
+
+	// Create dialer, honoring proxy settings
+	dialer, err := NewDialer(cfg.Proxy)
+	if err != nil {
+		log.Fatalf("Failed to configure proxy: %v", err)
+	}
+	if cfg.Transport != TransportQUIC {
+		if p, err := dialer.ProxyFor(addr); err != nil {
+			log.Fatalf("Failed to resolve proxy: %v", err)
+		} else if p != nil {
+			log.Printf("Using %s proxy %s", p.Scheme, p.Host)
+		}
+	}
 
 	// Create and run tunnel
-	tunnel := NewTunnel(addr, tlsConfig, cfg, portMap)
+	tunnel := NewTunnel(addr, tlsSource, cfg, portMap, dialer)
 	tunnel.Run()
 }
@@ -4,16 +4,54 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 
 	"z44-tunnel/common"
 )
 
+// Supported transports
+const (
+	TransportTLS       = "tls"
+	TransportWebSocket = "websocket"
+	TransportQUIC      = "quic"
+)
+
+// Config limits
+const (
+	MaxConnections  = 16 // Maximum parallel tunnel sessions
+	MaxResumeWindow = 60 // Maximum resume window in seconds
+)
+
 // Config represents the client configuration
+// Connections is optional and defaults to a single tunnel session
+// ResumeWindow is optional, zero disables stream resumption
+// WebSocketURL is required only with the websocket transport
+// Proxy is optional and overrides the HTTPS_PROXY environment variable
+// AdminAddr is optional and serves metrics such as certificate expiry
+// AutoRenew renews the client certificate over the tunnel before it expires
+// KeySource optionally loads the key from elsewhere than certs/client-key.pem
+// KeyPassphrase optionally decrypts an encrypted key, or is the PKCS#11 PIN
+// ServerPins optionally pins the server's public key (hex SPKI SHA-256), any listed key is accepted
+// Token optionally authenticates with a secret token (file:, env: or credential:) instead of a client certificate
+// TLS optionally restricts the TLS versions, cipher suites and key exchanges
 type Config struct {
-	ServerAddr string           `json:"server_addr"`
-	TunnelPort int              `json:"tunnel_port"`
-	Mappings   []common.Mapping `json:"mappings"`
+	ServerAddr    string           `json:"server_addr"`
+	TunnelPort    int              `json:"tunnel_port"`
+	Transport     string           `json:"transport,omitempty"`
+	WebSocketURL  string           `json:"websocket_url,omitempty"`
+	Proxy         string           `json:"proxy,omitempty"`
+	Connections   int              `json:"connections,omitempty"`
+	ResumeWindow  int              `json:"resume_window,omitempty"`
+	AdminAddr     string           `json:"admin_addr,omitempty"`
+	AutoRenew     bool             `json:"auto_renew,omitempty"`
+	ServerPins    []string         `json:"server_pins,omitempty"`
+	KeySource     string           `json:"key_source,omitempty"`
+	KeyPassphrase string           `json:"key_passphrase,omitempty"`
+	Token         string           `json:"token,omitempty"`
+	TLS           common.TLSPolicy `json:"tls,omitempty"`
+	Mappings      []common.Mapping `json:"mappings"`
 }
 
 // LoadConfig loads and validates the configuration from config.json
@@ -29,6 +67,18 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to decode config: %w", err)
 	}
 
+	if cfg.Transport == "" {
+		cfg.Transport = TransportTLS
+	}
+	if cfg.Connections == 0 {
+		cfg.Connections = 1
+	}
+	for i, pin := range cfg.ServerPins {
+		if cfg.ServerPins[i], err = common.NormalizePin(pin); err != nil {
+			return nil, fmt.Errorf("invalid configuration: server_pins[%d]: %w", i, err)
+		}
+	}
+
 	if err := validateConfig(cfg); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
@@ -44,6 +94,55 @@ func validateConfig(cfg Config) error {
 	if !common.ValidatePort(cfg.TunnelPort) {
 		return fmt.Errorf("tunnel_port must be between 1 and 65535, got %d", cfg.TunnelPort)
 	}
+	settings, err := cfg.TLS.Resolve()
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	switch cfg.Transport {
+	case TransportTLS:
+	case TransportQUIC:
+		if cfg.Proxy != "" {
+			return fmt.Errorf("proxy is not supported with the quic transport")
+		}
+		if !settings.AllowsTLS13() {
+			return fmt.Errorf("the quic transport needs TLS 1.3, which tls.max_version excludes")
+		}
+	case TransportWebSocket:
+		u, err := url.Parse(cfg.WebSocketURL)
+		if err != nil || u.Scheme != "wss" || u.Hostname() == "" {
+			return fmt.Errorf("websocket_url must be a wss:// URL, got '%s'", cfg.WebSocketURL)
+		}
+	default:
+		return fmt.Errorf("unknown transport '%s'", cfg.Transport)
+	}
+	if cfg.Proxy != "" {
+		if _, err := parseProxyURL(cfg.Proxy); err != nil {
+			return err
+		}
+	}
+	if cfg.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.AdminAddr); err != nil {
+			return fmt.Errorf("invalid admin_addr '%s': %w", cfg.AdminAddr, err)
+		}
+	}
+	if _, err := common.ParsePassphrase(cfg.KeyPassphrase); err != nil {
+		return fmt.Errorf("key_passphrase: %w", err)
+	}
+	if _, err := common.ParsePassphrase(cfg.Token); err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	if cfg.AutoRenew && cfg.Token != "" {
+		return fmt.Errorf("auto_renew renews a client certificate and cannot be used with token")
+	}
+	if cfg.AutoRenew && cfg.KeySource != "" {
+		return fmt.Errorf("auto_renew writes %s and cannot be used with key_source", clientKeyFile)
+	}
+	if cfg.Connections < 1 || cfg.Connections > MaxConnections {
+		return fmt.Errorf("connections must be between 1 and %d, got %d", MaxConnections, cfg.Connections)
+	}
+	if cfg.ResumeWindow < 0 || cfg.ResumeWindow > MaxResumeWindow {
+		return fmt.Errorf("resume_window must be between 0 and %d seconds, got %d", MaxResumeWindow, cfg.ResumeWindow)
+	}
 	if len(cfg.Mappings) == 0 {
 		return fmt.Errorf("mappings cannot be empty")
 	}
@@ -61,6 +160,19 @@ func validateConfig(cfg Config) error {
 	return nil
 }
 
+// Endpoint returns the TLS server name and dial address for the transport
+func (c *Config) Endpoint() (string, string) {
+	if c.Transport == TransportWebSocket {
+		u, _ := url.Parse(c.WebSocketURL)
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		return u.Hostname(), net.JoinHostPort(u.Hostname(), port)
+	}
+	return c.ServerAddr, net.JoinHostPort(c.ServerAddr, strconv.Itoa(c.TunnelPort))
+}
+
 // BuildPortMap creates a lookup map from remote port to local address
 func BuildPortMap(mappings []common.Mapping) map[int]string {
 	portMap := make(map[int]string)
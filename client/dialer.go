@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer opens the raw TCP connection to the server, directly or through
+// an HTTP CONNECT or SOCKS5 proxy
+type Dialer struct {
+	direct   *net.Dialer
+	proxyURL *url.URL
+	fromEnv  func(*url.URL) (*url.URL, error)
+}
+
+// NewDialer creates a dialer for the configured proxy
+// An empty proxy falls back to the HTTPS_PROXY and NO_PROXY environment variables
+func NewDialer(proxyURL string) (*Dialer, error) {
+	d := &Dialer{
+		direct: &net.Dialer{Timeout: DialTimeout, KeepAlive: TCPKeepAlive},
+	}
+
+	if proxyURL == "" {
+		d.fromEnv = httpproxy.FromEnvironment().ProxyFunc()
+		return d, nil
+	}
+
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	d.proxyURL = u
+	return d, nil
+}
+
+// parseProxyURL validates a proxy URL and its scheme
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s' (use http, socks5 or socks5h)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL '%s' has no host", proxyURL)
+	}
+	return u, nil
+}
+
+// ProxyFor returns the proxy used to reach addr, or nil for a direct connection
+func (d *Dialer) ProxyFor(addr string) (*url.URL, error) {
+	if d.proxyURL != nil {
+		return d.proxyURL, nil
+	}
+	u, err := d.fromEnv(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return parseProxyURL(u.String())
+}
+
+// Dial connects to addr, tunneling through a proxy when one applies
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	p, err := d.ProxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return d.direct.Dial("tcp", addr)
+	}
+
+	if p.Scheme == "http" {
+		return d.dialHTTPConnect(p, addr)
+	}
+	return d.dialSOCKS5(p, addr)
+}
+
+// dialHTTPConnect opens a tunnel with an HTTP CONNECT request
+func (d *Dialer) dialHTTPConnect(p *url.URL, addr string) (net.Conn, error) {
+	conn, err := d.direct.Dial("tcp", proxyHostPort(p, "80"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy %s: %w", p.Host, err)
+	}
+
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", p.Host, err)
+	}
+
+	// The server stays silent until the client starts the TLS handshake,
+	// so the buffered reader cannot swallow tunnel bytes
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", p.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT: %s", p.Host, resp.Status)
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 opens a tunnel through a SOCKS5 proxy
+// The proxy resolves the server name for both socks5 and socks5h
+func (d *Dialer) dialSOCKS5(p *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if p.User != nil {
+		password, _ := p.User.Password()
+		auth = &proxy.Auth{User: p.User.Username(), Password: password}
+	}
+
+	socks, err := proxy.SOCKS5("tcp", proxyHostPort(p, "1080"), auth, d.direct)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socks.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", p.Host, err)
+	}
+	return conn, nil
+}
+
+// proxyHostPort returns the proxy address, applying the default port if missing
+func proxyHostPort(p *url.URL, defaultPort string) string {
+	if p.Port() != "" {
+		return p.Host
+	}
+	return net.JoinHostPort(p.Hostname(), defaultPort)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"z44-tunnel/common"
+)
+
+// runEnroll requests a client certificate from the server with a one-time token
+// The key pair is generated here and only the CSR is sent
+func runEnroll(args []string) error {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	token := fs.String("token", "", "one-time enrollment token from 'utils issue-token'")
+	addr := fs.String("addr", "", "enrollment endpoint host:port (default server_addr:49154)")
+	keyAlgorithm := fs.String("key", common.DefaultKeyAlgorithm, "key algorithm")
+	force := fs.Bool("force", false, "replace an existing client certificate")
+	fs.Parse(args)
+
+	if *token == "" {
+		return errors.New("--token is required")
+	}
+	if _, err := os.Stat(clientKeyFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists (use --force to replace it)", clientKeyFile)
+	}
+
+	cfg, err := LoadConfig("config.json")
+	if err != nil {
+		return err
+	}
+	if *addr == "" {
+		*addr = net.JoinHostPort(cfg.ServerAddr, strconv.Itoa(common.DefaultEnrollPort))
+	}
+	host, _, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return fmt.Errorf("invalid --addr '%s': %w", *addr, err)
+	}
+
+	// The server is authenticated with the CA, the token authenticates us
+	pool, err := common.LoadCACertPool(caFile)
+	if err != nil {
+		return err
+	}
+	dialer, err := NewDialer(cfg.Proxy)
+	if err != nil {
+		return err
+	}
+	settings, _ := cfg.TLS.Resolve()
+
+	key, err := common.GenerateKey(*keyAlgorithm)
+	if err != nil {
+		return err
+	}
+	csr, err := common.NewCSR(key)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(common.EnrollRequest{Token: *token, CSR: csr})
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{
+		Timeout: DialTimeout,
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, address string) (net.Conn, error) {
+				return dialer.Dial(address)
+			},
+			TLSClientConfig: settings.Apply(&tls.Config{
+				RootCAs:    pool,
+				ServerName: host,
+				VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+					return checkServerPins(chains[0][0], cfg.ServerPins)
+				},
+			}),
+		},
+	}
+
+	log.Printf("Enrolling with %s...", *addr)
+	resp, err := httpClient.Post("https://"+*addr+common.EnrollPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("enrollment request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server refused enrollment: %s", bytes.TrimSpace(msg))
+	}
+
+	var enrolled common.EnrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&enrolled); err != nil {
+		return fmt.Errorf("invalid enrollment response: %w", err)
+	}
+	if err := common.CheckIssuedFor(enrolled.Certificate, key); err != nil {
+		return fmt.Errorf("invalid enrollment response: %w", err)
+	}
+
+	if err := os.MkdirAll("certs", 0700); err != nil {
+		return err
+	}
+	passphrase, err := common.ParsePassphrase(cfg.KeyPassphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeClientCertificate(key, enrolled, passphrase); err != nil {
+		return err
+	}
+
+	log.Printf("✅ Enrolled, certificate written to %s", clientCertFile)
+	return nil
+}
+
+// writeClientCertificate atomically replaces the client key, certificate and CA bundle
+// The key is staged next to the old one and moved in once the certificate is
+// written, recoverStagedKey completes the swap if the client stops in between
+// A reload in between fails the key check and keeps the old pair
+// A passphrase encrypts the new key like the one it replaces
+func writeClientCertificate(key crypto.Signer, issued common.EnrollResponse, passphrase common.Passphrase) error {
+	if err := common.WriteKey(stagedKeyFile, key, passphrase); err != nil {
+		return err
+	}
+	if err := common.WriteFileAtomic(clientCertFile, []byte(issued.Certificate), 0644); err != nil {
+		os.Remove(stagedKeyFile)
+		return err
+	}
+	if err := os.Rename(stagedKeyFile, clientKeyFile); err != nil {
+		return fmt.Errorf("failed to install new key: %w", err)
+	}
+	return common.WriteFileAtomic(caFile, []byte(issued.CA), 0644)
+}
+
+// recoverStagedKey finishes a key replacement cut short by a crash
+// A staged key matching the certificate is moved in, a staged key left over
+// from before the certificate was written is removed
+func recoverStagedKey(passphrase common.Passphrase) error {
+	if _, err := os.Stat(stagedKeyFile); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := common.LoadCertKeyPair(clientCertFile, common.FileKey(stagedKeyFile, passphrase)); err == nil {
+		log.Printf("🔁 Completing an interrupted certificate update, installing %s", stagedKeyFile)
+		return os.Rename(stagedKeyFile, clientKeyFile)
+	}
+	if _, err := common.LoadCertKeyPair(clientCertFile, common.FileKey(clientKeyFile, passphrase)); err != nil {
+		return fmt.Errorf("neither %s nor %s matches %s: %w", clientKeyFile, stagedKeyFile, clientCertFile, err)
+	}
+	return os.Remove(stagedKeyFile)
+}
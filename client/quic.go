@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"z44-tunnel/common"
+
+	"github.com/quic-go/quic-go"
+)
+
+// dialQUIC opens a QUIC connection to the server
+// Tunnel streams map to native QUIC streams, and connection IDs let the
+// session follow the client across address changes
+func dialQUIC(addr string, tlsConfig *tls.Config) (common.Session, tls.ConnectionState, error) {
+	quicTLS := tlsConfig.Clone()
+	quicTLS.NextProtos = []string{common.QUICProtocol}
+	quicTLS.MinVersion = tls.VersionTLS13
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, addr, quicTLS, common.QUICConfig(PingInterval, WriteTimeout))
+	if err != nil {
+		return nil, tls.ConnectionState{}, fmt.Errorf("QUIC handshake with %s failed: %w", addr, err)
+	}
+	state := conn.ConnectionState().TLS
+	common.RecordExpiry("server", state.PeerCertificates[0])
+	return common.NewQUICSession(conn), state, nil
+}
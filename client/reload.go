@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// ReloadPollInterval is how often certificate files are checked for changes
+const ReloadPollInterval = 10 * time.Second
+
+// handleReloads re-reads the certificates on SIGHUP and when the files change
+// Live sessions keep their handshake, the next reconnect uses the new files
+func handleReloads(certs *common.CertReloader) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in handleReloads: %v", r)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(ReloadPollInterval)
+	defer ticker.Stop()
+	expiry := time.NewTicker(common.ExpiryCheckInterval)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Println("🔄 SIGHUP received, reloading certificates")
+			if err := certs.Reload(); err != nil {
+				log.Printf("Failed to reload certificates: %v", err)
+			}
+		case <-expiry.C:
+			certs.CheckExpiry()
+		case <-ticker.C:
+			if reloaded, err := certs.ReloadIfChanged(); err != nil {
+				log.Printf("Failed to reload certificates: %v", err)
+			} else if reloaded {
+				log.Println("🔄 Certificates changed on disk, reloaded")
+			}
+		}
+	}
+}
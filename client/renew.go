@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// Renewal constants
+const (
+	RenewCheckInterval = time.Hour
+	RenewTimeout       = 30 * time.Second
+	RenewFraction      = 3 // Renew once less than 1/3 of the lifetime is left
+)
+
+// needsRenewal checks if a certificate has entered its renewal window
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Sub(now) < lifetime/RenewFraction
+}
+
+// maintainCertificate renews the client certificate over a session when it
+// gets close to expiry, until the session closes
+// Only one session renews at a time, the others see the new certificate
+func (t *Tunnel) maintainCertificate(session common.Session) {
+	ticker := time.NewTicker(RenewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		leaf := t.tlsSource.Certs().Certificate().Leaf
+		if needsRenewal(leaf, time.Now()) && t.renewing.CompareAndSwap(false, true) {
+			if err := t.renewCertificate(session); err != nil {
+				log.Printf("❌ Certificate renewal failed: %v", err)
+			}
+			t.renewing.Store(false)
+		}
+
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewCertificate requests a certificate for a fresh key of the same type
+// and installs it for the next reconnect
+func (t *Tunnel) renewCertificate(session common.Session) error {
+	certs := t.tlsSource.Certs()
+	key, err := common.GenerateKey(common.KeyAlgorithmOf(certs.Certificate().Leaf.PublicKey))
+	if err != nil {
+		return err
+	}
+	csr, err := common.NewCSR(key)
+	if err != nil {
+		return err
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open control stream: %w", err)
+	}
+	defer common.CloseConn(stream)
+	stream.SetDeadline(time.Now().Add(RenewTimeout))
+
+	if _, err := fmt.Fprintf(stream, "%s\n", common.RenewCommand); err != nil {
+		return fmt.Errorf("failed to send renewal request: %w", err)
+	}
+	if err := json.NewEncoder(stream).Encode(common.RenewRequest{CSR: csr}); err != nil {
+		return fmt.Errorf("failed to send renewal request: %w", err)
+	}
+
+	var renewed common.EnrollResponse
+	if err := json.NewDecoder(stream).Decode(&renewed); err != nil {
+		return fmt.Errorf("failed to read renewal response: %w", err)
+	}
+	if renewed.Error != "" {
+		return errors.New(renewed.Error)
+	}
+	if err := common.CheckIssuedFor(renewed.Certificate, key); err != nil {
+		return fmt.Errorf("invalid renewal response: %w", err)
+	}
+
+	passphrase, err := common.ParsePassphrase(t.cfg.KeyPassphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeClientCertificate(key, renewed, passphrase); err != nil {
+		return err
+	}
+	if err := certs.Reload(); err != nil {
+		return fmt.Errorf("failed to load renewed certificate: %w", err)
+	}
+
+	leaf := certs.Certificate().Leaf
+	log.Printf("🔁 Certificate renewed (serial %s, expires %s), used from the next reconnect",
+		leaf.SerialNumber.Text(16), leaf.NotAfter.Format("2006-01-02"))
+	return nil
+}
@@ -2,32 +2,55 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"z44-tunnel/common"
 )
 
 // handleStream handles an incoming stream from the server
-func handleStream(stream net.Conn, portMap map[int]string) {
-	defer common.CloseConn(stream)
-
-	portStr, err := bufio.NewReader(stream).ReadString('\n')
+// The header is "<port>" or "<port> <stream id>" for resumable streams,
+// or "RESUME <stream id> <offset>" to reattach a detached stream
+func (t *Tunnel) handleStream(stream net.Conn) {
+	line, err := bufio.NewReader(stream).ReadString('\n')
 	if err != nil && err != io.EOF {
 		log.Printf("Failed to read port: %v", err)
+		common.CloseConn(stream)
 		return
 	}
 
-	port, err := strconv.Atoi(strings.TrimSpace(portStr))
+	fields := strings.Fields(line)
+	if len(fields) == 3 && fields[0] == "RESUME" {
+		t.resumeStream(stream, fields[1], fields[2])
+		return
+	}
+	defer common.CloseConn(stream)
+
+	if len(fields) == 0 || len(fields) > 2 {
+		log.Printf("Invalid stream header: %s", strings.TrimSpace(line))
+		return
+	}
+
+	port, err := strconv.Atoi(fields[0])
 	if err != nil || !common.ValidatePort(port) {
-		log.Printf("Invalid port: %s", strings.TrimSpace(portStr))
+		log.Printf("Invalid port: %s", fields[0])
 		return
 	}
 
-	localAddr, ok := portMap[port]
+	var streamID uint64
+	if len(fields) == 2 {
+		if streamID, err = strconv.ParseUint(fields[1], 10, 64); err != nil || streamID == 0 {
+			log.Printf("Invalid stream ID: %s", fields[1])
+			return
+		}
+	}
+
+	localAddr, ok := t.portMap[port]
 	if !ok {
 		log.Printf("No mapping for port %d", port)
 		return
@@ -45,5 +68,46 @@ func handleStream(stream net.Conn, portMap map[int]string) {
 		return
 	}
 
-	common.PipeConnections(stream, local, "stream/local")
+	if streamID == 0 {
+		common.PipeConnections(stream, local, "stream/local")
+		return
+	}
+
+	window := time.Duration(t.cfg.ResumeWindow) * time.Second
+	rc := common.NewResumableConn(streamID, stream, window, nil)
+	t.resumable.Add(rc)
+	defer t.resumable.Remove(streamID)
+	defer common.CloseConn(rc)
+	common.PipeConnections(rc, local, "stream/local")
+}
+
+// resumeStream reattaches a detached resumable stream to a new server stream
+func (t *Tunnel) resumeStream(stream net.Conn, idStr, offsetStr string) {
+	id, err1 := strconv.ParseUint(idStr, 10, 64)
+	peerReceived, err2 := strconv.ParseUint(offsetStr, 10, 64)
+	if err1 != nil || err2 != nil {
+		log.Printf("Invalid resume request: %s %s", idStr, offsetStr)
+		common.CloseConn(stream)
+		return
+	}
+
+	rc := t.resumable.Get(id)
+	if rc == nil || rc.IsClosed() {
+		fmt.Fprintf(stream, "UNKNOWN\n")
+		common.CloseConn(stream)
+		return
+	}
+
+	// Stop reading from the old transport so the offset we report is final
+	rc.Detach()
+	if _, err := fmt.Fprintf(stream, "OK %d\n", rc.Received()); err != nil {
+		common.CloseConn(stream)
+		return
+	}
+	if err := rc.Attach(stream, peerReceived); err != nil {
+		log.Printf("Failed to resume stream %d: %v", id, err)
+		common.CloseConn(stream)
+		return
+	}
+	log.Printf("🔁 Resumed stream %d", id)
 }
@@ -2,30 +2,125 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"os"
 
 	"z44-tunnel/common"
 )
 
-// LoadTLSConfig loads the TLS configuration for the client
-func LoadTLSConfig(serverAddr string) (*tls.Config, error) {
-	// Load CA certificate pool
-	pool, err := common.LoadCACertPool("certs/ca.pem")
+// Client certificate files
+const (
+	clientCertFile = "certs/client-cert.pem"
+	clientKeyFile  = "certs/client-key.pem"
+	caFile         = "certs/ca.pem"
+	stagedKeyFile  = clientKeyFile + ".new" // A new key until its certificate is written
+)
+
+// TLSConfigSource builds client TLS configurations from certificates that
+// may be replaced on disk, every new connection uses the latest ones
+// certs is nil for a token client without a CA bundle
+type TLSConfigSource struct {
+	serverName string
+	pins       []string
+	certs      *common.CertReloader
+	settings   *common.TLSSettings
+}
+
+// LoadTLSConfig loads the client certificate, its key and the CA bundle
+// The key comes from key_source, by default certs/client-key.pem
+func LoadTLSConfig(cfg *Config) (*TLSConfigSource, error) {
+	serverName, _ := cfg.Endpoint()
+	settings, err := cfg.TLS.Resolve()
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Token != "" {
+		return loadTokenTLSConfig(cfg, serverName, settings)
+	}
 
-	// Load client certificate
-	cert, err := common.LoadCertKeyPair("certs/client-cert.pem", "certs/client-key.pem")
+	passphrase, err := common.ParsePassphrase(cfg.KeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KeySource == "" {
+		if err := recoverStagedKey(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	key, err := common.ParseKeySource(cfg.KeySource, clientKeyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := common.NewCertReloader(clientCertFile, key, caFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load client certificate: %w", err)
 	}
+	return &TLSConfigSource{serverName: serverName, pins: cfg.ServerPins, certs: certs, settings: settings}, nil
+}
+
+// loadTokenTLSConfig prepares a client without a certificate
+// The server is verified against certs/ca.pem if present, else by its pinned
+// key alone if server_pins is set, else against the system roots
+func loadTokenTLSConfig(cfg *Config, serverName string, settings *common.TLSSettings) (*TLSConfigSource, error) {
+	source := &TLSConfigSource{serverName: serverName, pins: cfg.ServerPins, settings: settings}
+	if _, err := os.Stat(caFile); err == nil {
+		if source.certs, err = common.NewCertReloader("", nil, caFile); err != nil {
+			return nil, err
+		}
+	}
+	return source, nil
+}
+
+// Settings returns the TLS policy applied to every connection
+func (s *TLSConfigSource) Settings() *common.TLSSettings {
+	return s.settings
+}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      pool,
-		ServerName:   serverAddr,
-		MinVersion:   tls.VersionTLS12,
-		CipherSuites: common.GetSecureCipherSuites(),
-	}, nil
+// Certs returns the reloadable client certificate and CA bundle, nil if none
+func (s *TLSConfigSource) Certs() *common.CertReloader {
+	return s.certs
+}
+
+// checkServerPins checks the server key against server_pins
+func checkServerPins(cert *x509.Certificate, pins []string) error {
+	if err := common.CheckPins(cert, pins); err != nil {
+		return fmt.Errorf("server_pins: %w", err)
+	}
+	return nil
+}
+
+// Config returns the TLS configuration for a new connection
+func (s *TLSConfigSource) Config() *tls.Config {
+	cfg := s.settings.Apply(&tls.Config{ServerName: s.serverName})
+	switch {
+	case s.certs != nil:
+		cfg.GetClientCertificate = s.certs.GetClientCertificate
+		// The built-in check only knows the intermediates the server sends,
+		// the chain and name are verified below with those of the CA bundle too,
+		// then the server key is checked against the pins
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			chains, err := s.certs.VerifyServerChain(rawCerts, s.serverName)
+			if err != nil {
+				return err
+			}
+			return checkServerPins(chains[0][0], s.pins)
+		}
+	case len(s.pins) > 0:
+		// Without a CA bundle a pinned key is trusted on its own, so the
+		// server may use a self-signed certificate
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("failed to parse server certificate: %w", err)
+			}
+			return checkServerPins(cert, s.pins)
+		}
+	}
+	return cfg
 }
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"z44-tunnel/common"
@@ -26,27 +31,54 @@ const (
 // Tunnel manages the connection to the server
 type Tunnel struct {
 	addr      string
-	tlsConfig *tls.Config
+	tlsSource *TLSConfigSource
 	cfg       *Config
 	portMap   map[int]string
+	clientID  string
+	resumable *common.ResumeRegistry
+	dialer    *Dialer
+	renewing  atomic.Bool // Set while a session renews the client certificate
 }
 
 // NewTunnel creates a new tunnel instance
-func NewTunnel(addr string, tlsConfig *tls.Config, cfg *Config, portMap map[int]string) *Tunnel {
+func NewTunnel(addr string, tlsSource *TLSConfigSource, cfg *Config, portMap map[int]string, dialer *Dialer) *Tunnel {
 	return &Tunnel{
 		addr:      addr,
-		tlsConfig: tlsConfig,
+		tlsSource: tlsSource,
 		cfg:       cfg,
 		portMap:   portMap,
+		clientID:  newClientID(),
+		resumable: common.NewResumeRegistry(),
+		dialer:    dialer,
 	}
 }
 
-// Run starts the tunnel connection loop
+// newClientID generates a random ID shared by all sessions of this process
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Run starts one connection loop per configured session and blocks forever
 func (t *Tunnel) Run() {
+	var wg sync.WaitGroup
+	for i := 1; i <= t.cfg.Connections; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			t.runSession(id)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runSession keeps a single tunnel session connected
+func (t *Tunnel) runSession(id int) {
 	for {
-		log.Printf("Connecting to %s...", t.addr)
+		log.Printf("Connecting to %s (session %d/%d)...", t.addr, id, t.cfg.Connections)
 		t.connect()
-		log.Println("Disconnected. Retrying in 200ms...")
+		log.Printf("Session %d disconnected. Retrying in 200ms...", id)
 		time.Sleep(RetryDelay)
 	}
 }
@@ -59,33 +91,30 @@ func (t *Tunnel) connect() {
 		}
 	}()
 
-	raw, err := (&net.Dialer{Timeout: DialTimeout, KeepAlive: TCPKeepAlive}).Dial("tcp", t.addr)
-	if err != nil {
-		log.Printf("Failed to dial %s: %v", t.addr, err)
-		return
-	}
-	defer common.CloseConn(raw)
-
-	conn := tls.Client(raw, t.tlsConfig)
-	if err := conn.Handshake(); err != nil {
-		log.Printf("TLS handshake failed: %v", err)
-		common.CloseConn(conn)
-		return
-	}
-	log.Println("✅ Connected!")
-
-	session, err := yamux.Client(conn, common.YamuxConfig(PingInterval, WriteTimeout))
+	session, state, err := t.openSession()
 	if err != nil {
-		log.Printf("Failed to create yamux session: %v", err)
+		log.Printf("Failed to connect: %v", err)
 		return
 	}
 	defer common.CloseSession(session)
+	log.Printf("✅ Connected! (%s)", common.DescribeTLS(state))
 
 	if err := t.sendHandshake(session); err != nil {
 		log.Printf("Failed to send handshake: %v", err)
 		return
 	}
 
+	if t.cfg.AutoRenew {
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in maintainCertificate: %v", r)
+				}
+			}()
+			t.maintainCertificate(session)
+		}()
+	}
+
 	for {
 		stream, err := session.Accept()
 		if err != nil {
@@ -100,20 +129,71 @@ func (t *Tunnel) connect() {
 					log.Printf("Panic in handleStream: %v", r)
 				}
 			}()
-			handleStream(s, t.portMap)
+			t.handleStream(s)
 		}(stream)
 	}
 }
 
+// openSession establishes the transport and multiplexed session to the server
+// It also returns the negotiated TLS parameters for logging
+func (t *Tunnel) openSession() (common.Session, tls.ConnectionState, error) {
+	if t.cfg.Transport == TransportQUIC {
+		return dialQUIC(t.addr, t.tlsSource.Config())
+	}
+
+	raw, err := t.dialer.Dial(t.addr)
+	if err != nil {
+		return nil, tls.ConnectionState{}, fmt.Errorf("failed to dial %s: %w", t.addr, err)
+	}
+
+	tlsConn := tls.Client(raw, t.tlsSource.Config())
+	if err := tlsConn.Handshake(); err != nil {
+		common.CloseConn(tlsConn)
+		return nil, tls.ConnectionState{}, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	state := tlsConn.ConnectionState()
+	common.RecordExpiry("server", state.PeerCertificates[0])
+
+	var conn net.Conn = tlsConn
+	if t.cfg.Transport == TransportWebSocket {
+		if conn, err = upgradeWebSocket(tlsConn, t.cfg.WebSocketURL); err != nil {
+			common.CloseConn(tlsConn)
+			return nil, state, fmt.Errorf("WebSocket upgrade failed: %w", err)
+		}
+	}
+
+	// Closing the session closes the underlying connection
+	session, err := yamux.Client(conn, common.YamuxConfig(PingInterval, WriteTimeout))
+	if err != nil {
+		common.CloseConn(conn)
+		return nil, state, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	return session, state, nil
+}
+
 // sendHandshake sends the initial handshake to the server
-func (t *Tunnel) sendHandshake(session *yamux.Session) error {
+// The token is read on every connection so it can be rotated on disk
+func (t *Tunnel) sendHandshake(session common.Session) error {
+	var token string
+	if t.cfg.Token != "" {
+		read, _ := common.ParsePassphrase(t.cfg.Token)
+		b, err := read()
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		token = string(b)
+	}
+
 	stream, err := session.Open()
 	if err != nil {
 		return err
 	}
 	defer common.CloseConn(stream)
 
-	return json.NewEncoder(stream).Encode(struct {
-		Mappings []common.Mapping `json:"mappings"`
-	}{Mappings: t.cfg.Mappings})
+	return json.NewEncoder(stream).Encode(common.Handshake{
+		Mappings:     t.cfg.Mappings,
+		ClientID:     t.clientID,
+		ResumeWindow: t.cfg.ResumeWindow,
+		Token:        token,
+	})
 }
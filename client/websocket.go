@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+)
+
+// upgradeWebSocket performs the WebSocket handshake over an established TLS connection
+// The yamux session is then carried in binary frames, which passes HTTP(S)-only proxies
+func upgradeWebSocket(conn net.Conn, wsURL string) (net.Conn, error) {
+	location, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &websocket.Config{
+		Location: location,
+		Origin:   &url.URL{Scheme: "https", Host: location.Host},
+		Version:  websocket.ProtocolVersionHybi13,
+	}
+
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
@@ -0,0 +1,26 @@
+package common
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ServeAdmin serves the metrics published with expvar as JSON on /debug/vars
+// It should listen on a local or otherwise protected address
+func ServeAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("📊 Admin endpoint ready on http://%s/debug/vars", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("Admin endpoint stopped: %v", err)
+	}
+}
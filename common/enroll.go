@@ -0,0 +1,277 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// Enrollment settings
+const (
+	EnrollPath        = "/enroll"
+	DefaultEnrollPort = 49154
+	enrollTokenFile   = "enroll-tokens.json"
+	RenewCommand      = "RENEW" // Starts a renewal request on a control stream of the tunnel
+)
+
+// EnrollRequest is sent by a new client to obtain its certificate
+// The private key of the CSR never leaves the client
+type EnrollRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr"` // PEM encoded certificate request
+}
+
+// EnrollResponse carries the signed client certificate and the CA bundle
+// It also answers renewal requests, where Error reports a refusal
+type EnrollResponse struct {
+	Certificate string `json:"certificate,omitempty"`
+	CA          string `json:"ca,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RenewRequest asks for a new certificate for the identity of the session
+// it is sent on, after a "RENEW" line on a client opened stream
+type RenewRequest struct {
+	CSR string `json:"csr"` // PEM encoded certificate request
+}
+
+// EnrollToken is a pending one-time enrollment, only the token hash is stored
+type EnrollToken struct {
+	Hash    string    `json:"hash"`
+	Name    string    `json:"name"`
+	URI     string    `json:"uri,omitempty"`
+	Days    int       `json:"days"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewToken generates a random 256-bit token, hex encoded
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the stored form of a token
+// Tokens are 256-bit random values, so a plain SHA-256 is enough
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTokens reads the pending tokens, dropping expired ones
+func (s *CertStore) loadTokens() ([]EnrollToken, error) {
+	data, err := os.ReadFile(s.Path(enrollTokenFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []EnrollToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode enrollment tokens: %w", err)
+	}
+
+	now := time.Now()
+	valid := tokens[:0]
+	for _, t := range tokens {
+		if now.Before(t.Expires) {
+			valid = append(valid, t)
+		}
+	}
+	return valid, nil
+}
+
+// saveTokens writes the pending tokens atomically, the caller holds the store lock
+func (s *CertStore) saveTokens(tokens []EnrollToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.Path(enrollTokenFile), append(data, '\n'), 0600)
+}
+
+// AddToken creates a one-time enrollment token for a client identity
+// The token itself is returned once and never stored
+func (s *CertStore) AddToken(name, uri string, days int, ttl time.Duration) (string, error) {
+	if _, err := ClientTemplate(name, uri); err != nil {
+		return "", err
+	}
+
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	tokens, err := s.loadTokens()
+	if err != nil {
+		return "", err
+	}
+	tokens = append(tokens, EnrollToken{
+		Hash:    HashToken(token),
+		Name:    name,
+		URI:     uri,
+		Days:    days,
+		Expires: time.Now().Add(ttl),
+	})
+	if err := s.saveTokens(tokens); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeToken removes a valid token and returns what it grants
+// The store lock makes sure a token is used once, even by another process
+func (s *CertStore) ConsumeToken(token string) (*EnrollToken, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	tokens, err := s.loadTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := HashToken(token)
+	for i, t := range tokens {
+		if t.Hash != hash {
+			continue
+		}
+		tokens = append(tokens[:i], tokens[i+1:]...)
+		if err := s.saveTokens(tokens); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+	return nil, errors.New("invalid or expired enrollment token")
+}
+
+// Enroll signs the certificate request of a client granted by a token and
+// records it in the index
+// The CSR is parsed with ParseCSR before the token is consumed, so a bad
+// request does not use up the token
+func (s *CertStore) Enroll(t *EnrollToken, csr *x509.CertificateRequest) ([]byte, error) {
+	// The identity comes from the token, never from the CSR subject
+	template, err := ClientTemplate(t.Name, t.URI)
+	if err != nil {
+		return nil, err
+	}
+	der, err := s.Sign(template, csr.PublicKey, t.Days)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Record(IndexEntry{
+		Serial:   template.SerialNumber.Text(16),
+		Type:     CertTypeClient,
+		Name:     t.Name,
+		NotAfter: template.NotAfter,
+	}, ""); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// RenewClient signs a new certificate with the identity and lifetime of a
+// client's current certificate for the key of its CSR
+func (s *CertStore) RenewClient(current *x509.Certificate, csrPem string) ([]byte, error) {
+	csr, err := ParseCSR(csrPem)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject:     current.Subject,
+		URIs:        current.URIs,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	days := int(math.Round(current.NotAfter.Sub(current.NotBefore).Hours() / 24))
+
+	// Checking, signing and recording under the store lock keeps concurrent
+	// renewals of one certificate from forking a second line of renewals
+	serial := current.SerialNumber.Text(16)
+	var der []byte
+	err = s.UpdateIndex(func(idx *Index) error {
+		if e, err := idx.Find(serial, ""); err == nil && !e.Active() {
+			return fmt.Errorf("certificate %s is %s", serial, e.Status(time.Now()))
+		}
+		signed, err := s.Sign(template, csr.PublicKey, days)
+		if err != nil {
+			return err
+		}
+		der = signed
+		idx.Add(IndexEntry{
+			Serial:   template.SerialNumber.Text(16),
+			Type:     CertTypeClient,
+			Name:     current.Subject.CommonName,
+			NotAfter: template.NotAfter,
+		}, serial)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// NewCSR creates a PEM certificate request for a key
+// The server decides the identity, so the subject is informational only
+func NewCSR(key crypto.Signer) (string, error) {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "z44-client"},
+	}, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create CSR: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})), nil
+}
+
+// ParseCSR decodes a PEM certificate request and checks its signature
+func ParseCSR(csrPem string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPem))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("CSR is not a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %w", err)
+	}
+	return csr, nil
+}
+
+// CheckIssuedFor checks that a PEM certificate returned by the server is for a key
+func CheckIssuedFor(certPem string, key crypto.Signer) error {
+	block, _ := pem.Decode([]byte(certPem))
+	if block == nil {
+		return errors.New("no certificate returned")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid certificate returned: %w", err)
+	}
+	if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return errors.New("certificate returned for another key")
+	}
+	return nil
+}
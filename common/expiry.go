@@ -0,0 +1,54 @@
+package common
+
+import (
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Expiry monitoring settings
+const (
+	ExpiryWarningPeriod = 30 * 24 * time.Hour // Warn when a certificate expires within this period
+	ExpiryCheckInterval = 12 * time.Hour      // How often the own certificates are checked
+)
+
+// certExpiryDays exposes the days until expiry of every certificate seen,
+// keyed by role ("own", "ca", "server", "client/<name>")
+var certExpiryDays = expvar.NewMap("cert_expiry_days")
+
+// DaysUntilExpiry returns the number of days until the certificate expires,
+// negative once it has expired
+func DaysUntilExpiry(cert *x509.Certificate) float64 {
+	return time.Until(cert.NotAfter).Hours() / 24
+}
+
+// CheckValidity returns an error if the certificate is expired or not yet valid
+func CheckValidity(path string, cert *x509.Certificate) error {
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s (%s) expired on %s, renew it with 'go run ./utils renew'",
+			path, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate %s (%s) is not valid before %s, check the system clock",
+			path, cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RecordExpiry publishes the days until expiry of a certificate and logs a
+// warning when it is close to expiring
+func RecordExpiry(role string, cert *x509.Certificate) {
+	days := DaysUntilExpiry(cert)
+
+	v := new(expvar.Float)
+	v.Set(days)
+	certExpiryDays.Set(role, v)
+
+	if days < ExpiryWarningPeriod.Hours()/24 {
+		log.Printf("⚠️ The %s certificate (%s, serial %s) expires in %.1f days on %s",
+			role, cert.Subject.CommonName, cert.SerialNumber.Text(16), days, cert.NotAfter.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package common
+
+// lockFile is a no-op where flock is not available, the store mutex still
+// serializes updates within one process
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Supported key algorithms
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA3072   = "rsa3072"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+
+	// RSA-2048 stays the default so existing workflows keep issuing the
+	// same keys, ECDSA and Ed25519 are chosen explicitly
+	DefaultKeyAlgorithm = KeyRSA2048
+)
+
+// KeyAlgorithms lists the supported key algorithms
+var KeyAlgorithms = []string{KeyRSA2048, KeyRSA3072, KeyRSA4096, KeyECDSAP256, KeyECDSAP384, KeyEd25519}
+
+// GenerateKey creates a private key with the given algorithm
+func GenerateKey(algorithm string) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case KeyRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case KeyRSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm '%s' (%s)", algorithm, strings.Join(KeyAlgorithms, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", algorithm, err)
+	}
+	return key, nil
+}
+
+// KeyAlgorithmOf returns the algorithm of a public key, so a replacement key
+// can be generated with the same one
+func KeyAlgorithmOf(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch bits := k.N.BitLen(); {
+		case bits > 3072:
+			return KeyRSA4096
+		case bits > 2048:
+			return KeyRSA3072
+		default:
+			return KeyRSA2048
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return KeyECDSAP384
+		}
+		return KeyECDSAP256
+	case ed25519.PublicKey:
+		return KeyEd25519
+	default:
+		return DefaultKeyAlgorithm
+	}
+}
+
+// leafKeyUsage returns the key usage of a leaf certificate for a public key
+// Only RSA keys are used for key encipherment
+func leafKeyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// WriteKey writes a private key as PKCS#8, encrypted if a passphrase is given
+func WriteKey(filename string, key crypto.Signer, passphrase Passphrase) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	if passphrase == nil {
+		return WritePem(filename, "PRIVATE KEY", der)
+	}
+
+	pass, err := passphrase()
+	if err != nil {
+		return fmt.Errorf("failed to get key passphrase: %w", err)
+	}
+	encrypted, err := EncryptPKCS8(der, pass)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt private key: %w", err)
+	}
+	return WritePem(filename, "ENCRYPTED PRIVATE KEY", encrypted)
+}
+
+// DescribeKey returns the algorithm and size of a public key
+func DescribeKey(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
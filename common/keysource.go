@@ -0,0 +1,202 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CredentialsDirEnv is where systemd places LoadCredential= secrets
+const CredentialsDirEnv = "CREDENTIALS_DIRECTORY"
+
+// Passphrase returns the passphrase of an encrypted key
+// It is only called when a key turns out to be encrypted
+type Passphrase func() ([]byte, error)
+
+// ParsePassphrase parses where a passphrase comes from:
+// "file:/path", "env:NAME" or "credential:NAME" (systemd LoadCredential=)
+// An empty spec returns nil, for keys that are not encrypted
+func ParsePassphrase(spec string) (Passphrase, error) {
+	kind, value, _ := strings.Cut(spec, ":")
+	switch {
+	case spec == "":
+		return nil, nil
+	case value == "":
+		return nil, fmt.Errorf("invalid passphrase source '%s', expected file:, env: or credential:", spec)
+	case kind == "file":
+		return func() ([]byte, error) {
+			return readSecret(value)
+		}, nil
+	case kind == "credential":
+		return func() ([]byte, error) {
+			path, err := credentialPath(value)
+			if err != nil {
+				return nil, err
+			}
+			return readSecret(path)
+		}, nil
+	case kind == "env":
+		return func() ([]byte, error) {
+			pass := os.Getenv(value)
+			if pass == "" {
+				return nil, fmt.Errorf("environment variable %s is not set", value)
+			}
+			return []byte(pass), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid passphrase source '%s', expected file:, env: or credential:", spec)
+	}
+}
+
+// readSecret reads a secret file without its trailing newline
+func readSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return data, nil
+}
+
+// credentialPath returns the path of a systemd credential
+func credentialPath(name string) (string, error) {
+	dir := os.Getenv(CredentialsDirEnv)
+	if dir == "" {
+		return "", fmt.Errorf("credential '%s' requested but %s is not set (use LoadCredential= in the unit)", name, CredentialsDirEnv)
+	}
+	if name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid credential name '%s'", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// KeySource loads a private key from wherever it is kept
+type KeySource interface {
+	// Load returns the key, ready to sign
+	Load() (crypto.Signer, error)
+	// Path returns the file to watch for changes, empty if the key cannot change
+	Path() string
+	// String describes the source for logs
+	String() string
+}
+
+// ParseKeySource parses where a private key comes from:
+//   - "" or "file:/path" for a PEM file, defaultPath if empty
+//   - "fd:N" for PEM read once from an inherited file descriptor
+//   - "credential:NAME" for a file placed by systemd LoadCredential=
+//   - "pkcs11:..." for a key in a PKCS#11 token (RFC 7512 URI, needs -tags pkcs11)
+//
+// The passphrase decrypts encrypted PEM keys, or is the PIN of a PKCS#11 token
+func ParseKeySource(spec, defaultPath string, passphrase Passphrase) (KeySource, error) {
+	kind, value, _ := strings.Cut(spec, ":")
+	switch {
+	case spec == "":
+		return FileKey(defaultPath, passphrase), nil
+	case kind == "pkcs11":
+		return newPKCS11KeySource(spec, passphrase)
+	case value == "":
+		return nil, fmt.Errorf("invalid key source '%s'", spec)
+	case kind == "file":
+		return FileKey(value, passphrase), nil
+	case kind == "credential":
+		path, err := credentialPath(value)
+		if err != nil {
+			return nil, err
+		}
+		return FileKey(path, passphrase), nil
+	case kind == "fd":
+		fd, err := strconv.Atoi(value)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor in key source '%s'", spec)
+		}
+		return readFDKey(fd, passphrase)
+	default:
+		return nil, fmt.Errorf("invalid key source '%s', expected file:, fd:, credential: or pkcs11:", spec)
+	}
+}
+
+// fileKey is a PEM key file, optionally encrypted
+type fileKey struct {
+	path       string
+	passphrase Passphrase
+}
+
+// FileKey returns the key source of a PEM file
+func FileKey(path string, passphrase Passphrase) KeySource {
+	return &fileKey{path: path, passphrase: passphrase}
+}
+
+// Load reads and parses the key file
+func (k *fileKey) Load() (crypto.Signer, error) {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	key, err := ParsePrivateKeyPEM(data, k.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", k.path, err)
+	}
+	return key, nil
+}
+
+// Path returns the key file
+func (k *fileKey) Path() string {
+	return k.path
+}
+
+// String describes the key file
+func (k *fileKey) String() string {
+	return k.path
+}
+
+// fdKey is a PEM key read from a file descriptor, which can be read only once
+type fdKey struct {
+	fd         int
+	data       []byte
+	passphrase Passphrase
+}
+
+// readFDKey reads the key from a file descriptor and closes it
+func readFDKey(fd int, passphrase Passphrase) (KeySource, error) {
+	f := os.NewFile(uintptr(fd), "fd:"+strconv.Itoa(fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key from fd %d: %w", fd, err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("no key on fd " + strconv.Itoa(fd))
+	}
+	return &fdKey{fd: fd, data: data, passphrase: passphrase}, nil
+}
+
+// Load parses the key read at startup
+func (k *fdKey) Load() (crypto.Signer, error) {
+	key, err := ParsePrivateKeyPEM(k.data, k.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", k, err)
+	}
+	return key, nil
+}
+
+// Path is empty, the key cannot change
+func (k *fdKey) Path() string {
+	return ""
+}
+
+// String describes the file descriptor
+func (k *fdKey) String() string {
+	return "fd:" + strconv.Itoa(k.fd)
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SPKIPin returns the hex SHA-256 of a certificate's public key (SPKI)
+// It survives renewals that keep the key, unlike the certificate fingerprint
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// PublicKeyPin returns the SPKI pin of a public key
+func PublicKeyPin(pub crypto.PublicKey) (string, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+	sum := sha256.Sum256(spki)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// NormalizePin lowercases a hex SPKI pin and strips colons
+func NormalizePin(pin string) (string, error) {
+	pin = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+	if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid pin '%s', expected the hex SHA-256 of a public key", pin)
+	}
+	return pin, nil
+}
+
+// CheckPins checks that a certificate's public key matches one of the pins
+// No pins accepts any key
+func CheckPins(cert *x509.Certificate, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	if observed := SPKIPin(cert); !slices.Contains(pins, observed) {
+		return fmt.Errorf("public key of %s matches none of the pinned keys (observed %s)",
+			cert.Subject.CommonName, observed)
+	}
+	return nil
+}
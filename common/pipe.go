@@ -1,12 +1,40 @@
 package common
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
 )
 
+// CloseReason tells why a pipe ended
+type CloseReason string
+
+// Close reasons
+const (
+	CloseSrcDone     CloseReason = "src_closed"         // src ended first
+	CloseDstDone     CloseReason = "dst_closed"         // dst ended first
+	CloseIdleTimeout CloseReason = "idle_timeout"       // No data in either direction for PipeLimits.IdleTimeout
+	CloseMaxLifetime CloseReason = "max_lifetime"       // The pipe ran for PipeLimits.MaxLifetime
+	CloseHalfOpen    CloseReason = "half_close_timeout" // One side ended and the other sent nothing for HalfCloseTimeout
+	CloseQuota       CloseReason = "quota_exceeded"     // A side failed with ErrQuotaExceeded
+)
+
+// HalfCloseTimeout is how long a pipe with one direction ended waits without
+// data for the other one to end, so peers that never close do not leak it
+const HalfCloseTimeout = time.Minute
+
+// PipeLimits bounds how long a pipe may run, zero values disable a bound
+type PipeLimits struct {
+	IdleTimeout time.Duration // Without data in either direction
+	MaxLifetime time.Duration // Since the pipe started
+}
+
 // isExpectedConnectionError checks if error is expected during normal connection closure
 func isExpectedConnectionError(err error) bool {
 	if err == nil {
@@ -18,40 +46,179 @@ func isExpectedConnectionError(err error) bool {
 		strings.Contains(s, "use of closed network connection")
 }
 
+// CloseWrite ends the write direction of a connection so its peer reads EOF,
+// while reading goes on. TCP and TLS connections send a FIN or close_notify,
+// yamux streams a FIN, QUIC streams finish their send direction and
+// resumable streams send a FIN frame
+func CloseWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case *yamux.Stream:
+		// Close only ends the write direction until the peer closes too
+		return c.Close()
+	}
+	return errors.ErrUnsupported
+}
+
+// activityReader records the time of the last read that returned data
+type activityReader struct {
+	io.Reader
+	last *atomic.Int64 // Unix nanoseconds
+}
+
+// Read reads and records activity
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
 // PipeConnections pipes data bidirectionally between two connections
+// A direction that reaches EOF closes the write side of its destination so
+// the other direction finishes on its own, a failed direction closes both
+// The other direction is then closed once idle for HalfCloseTimeout
 // It handles panic recovery and proper error logging
 func PipeConnections(src, dst net.Conn, label string) {
-	done := make(chan struct{}, 2)
+	PipeWithLimits(src, dst, label, PipeLimits{})
+}
+
+// endDirection passes the end of a copy from one connection to the other
+// EOF half-closes the destination, an error or a destination without
+// half-close closes both so the other copy does not wait forever
+func endDirection(from, to net.Conn, err error) {
+	if err == nil && CloseWrite(to) == nil {
+		return
+	}
+	CloseConn(from)
+	CloseConn(to)
+}
+
+// PipeWithLimits pipes data bidirectionally between two connections like
+// PipeConnections, closing both once a limit is reached
+// It returns the limit that closed the pipe, or else the side that ended first
+func PipeWithLimits(src, dst net.Conn, label string, limits PipeLimits) CloseReason {
+	start := time.Now()
+	var lastActive atomic.Int64
+	lastActive.Store(start.UnixNano())
+
+	srcReader := &activityReader{Reader: src, last: &lastActive}
+	dstReader := &activityReader{Reader: dst, last: &lastActive}
+
+	done := make(chan CloseReason, 2)
+	var expired atomic.Bool // Set when a limit closes the pipe, the copy errors are then expected
 
 	// Copy from src to dst
 	go func() {
+		reason := CloseSrcDone
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("Panic in %s copy (src->dst): %v", label, r)
 			}
-			done <- struct{}{}
+			done <- reason
 		}()
-		_, err := io.Copy(dst, src)
-		if err != nil && err != io.EOF && !isExpectedConnectionError(err) {
+		_, err := io.Copy(dst, srcReader)
+		if errors.Is(err, ErrQuotaExceeded) {
+			reason = CloseQuota
+		} else if err != nil && err != io.EOF && !isExpectedConnectionError(err) && !expired.Load() {
 			log.Printf("Error copying %s (src->dst): %v", label, err)
 		}
+		endDirection(src, dst, err)
 	}()
 
 	// Copy from dst to src
 	go func() {
+		reason := CloseDstDone
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("Panic in %s copy (dst->src): %v", label, r)
 			}
-			done <- struct{}{}
+			done <- reason
 		}()
-		_, err := io.Copy(src, dst)
-		if err != nil && err != io.EOF && !isExpectedConnectionError(err) {
+		_, err := io.Copy(src, dstReader)
+		if errors.Is(err, ErrQuotaExceeded) {
+			reason = CloseQuota
+		} else if err != nil && err != io.EOF && !isExpectedConnectionError(err) && !expired.Load() {
 			log.Printf("Error copying %s (dst->src): %v", label, err)
 		}
+		endDirection(dst, src, err)
 	}()
 
-	// Wait for both copies to complete
-	<-done
-	<-done
+	// Once one direction ended, the other may idle for HalfCloseTimeout at most
+	halfClosed := false
+	idleLimit := func() time.Duration {
+		if halfClosed && (limits.IdleTimeout == 0 || limits.IdleTimeout > HalfCloseTimeout) {
+			return HalfCloseTimeout
+		}
+		return limits.IdleTimeout
+	}
+
+	// nextCheck returns when the next limit may be reached
+	nextCheck := func(now time.Time) time.Duration {
+		var wait time.Duration
+		if limits.MaxLifetime > 0 {
+			wait = start.Add(limits.MaxLifetime).Sub(now)
+		}
+		if idle := idleLimit(); idle > 0 {
+			idle = time.Unix(0, lastActive.Load()).Add(idle).Sub(now)
+			if wait == 0 || idle < wait {
+				wait = idle
+			}
+		}
+		return max(wait, time.Millisecond)
+	}
+
+	// Wait for both copies to complete, closing both sides once a limit is reached
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+	schedule := func(now time.Time) {
+		if limits.MaxLifetime > 0 || idleLimit() > 0 {
+			timer.Reset(nextCheck(now))
+		}
+	}
+	schedule(start)
+
+	var reason CloseReason
+	for pending := 2; pending > 0; {
+		select {
+		case r := <-done:
+			pending--
+			if r == CloseQuota {
+				reason = r
+			}
+			if reason == "" {
+				reason = r
+				halfClosed = true
+				now := time.Now()
+				lastActive.Store(now.UnixNano())
+				schedule(now)
+			}
+		case now := <-timer.C:
+			var limit CloseReason
+			if limits.MaxLifetime > 0 && now.Sub(start) >= limits.MaxLifetime {
+				limit = CloseMaxLifetime
+			} else if idle := idleLimit(); idle > 0 && now.Sub(time.Unix(0, lastActive.Load())) >= idle {
+				limit = CloseIdleTimeout
+				if idle != limits.IdleTimeout {
+					limit = CloseHalfOpen
+				}
+			}
+			if limit == "" {
+				schedule(now)
+				continue
+			}
+			// Past deadlines unblock both copies, Close alone only
+			// half-closes a yamux stream
+			reason = limit
+			expired.Store(true)
+			src.SetDeadline(now)
+			dst.SetDeadline(now)
+			CloseConn(src)
+			CloseConn(dst)
+		}
+	}
+	return reason
 }
@@ -0,0 +1,376 @@
+//go:build pkcs11
+
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Modules keeps one initialized context per module, a module may only
+// be initialized once per process
+var (
+	pkcs11Mu      sync.Mutex
+	pkcs11Modules = make(map[string]*pkcs11.Ctx)
+)
+
+// Named curve identifiers as stored in CKA_EC_PARAMS
+var (
+	oidCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// DigestInfo prefixes for RSA PKCS#1 v1.5 signatures with CKM_RSA_PKCS
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// PSS hash mechanisms and mask generation functions
+var pssMechanisms = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// pkcs11KeySource is a key kept in a PKCS#11 token, addressed by an RFC 7512 URI
+// e.g. pkcs11:token=z44;object=server-key?module-path=/usr/lib/softhsm/libsofthsm2.so
+type pkcs11KeySource struct {
+	uri    string
+	module string
+	token  string
+	slot   string
+	object string
+	id     string
+	pin    Passphrase
+
+	mu     sync.Mutex
+	signer *pkcs11Signer
+}
+
+// newPKCS11KeySource parses a PKCS#11 URI
+// The PIN comes from pin-value, pin-source (a file) or else the passphrase
+func newPKCS11KeySource(uri string, passphrase Passphrase) (KeySource, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "pkcs11:"), "?")
+	attrs := make(map[string]string)
+	for _, part := range append(strings.Split(path, ";"), strings.Split(query, "&")...) {
+		if part == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(part, "=")
+		value, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute '%s': %w", part, err)
+		}
+		attrs[k] = value
+	}
+
+	s := &pkcs11KeySource{
+		uri:    uri,
+		module: attrs["module-path"],
+		token:  attrs["token"],
+		slot:   attrs["slot-id"],
+		object: attrs["object"],
+		id:     attrs["id"],
+		pin:    passphrase,
+	}
+	if s.module == "" {
+		return nil, errors.New("PKCS#11 URI needs module-path")
+	}
+	if s.object == "" && s.id == "" {
+		return nil, errors.New("PKCS#11 URI needs object or id")
+	}
+	if pin, ok := attrs["pin-value"]; ok {
+		s.pin = func() ([]byte, error) { return []byte(pin), nil }
+	} else if source, ok := attrs["pin-source"]; ok {
+		file := strings.TrimPrefix(source, "file:")
+		s.pin = func() ([]byte, error) { return readSecret(file) }
+	}
+	return s, nil
+}
+
+// Load opens a session on the token and finds the key
+// The signer is kept, the key in the token does not change
+func (s *pkcs11KeySource) Load() (crypto.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signer != nil {
+		return s.signer, nil
+	}
+
+	ctx, err := pkcs11Module(s.module)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := s.findSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	if s.pin != nil {
+		pin, err := s.pin()
+		if err != nil {
+			ctx.CloseSession(session)
+			return nil, fmt.Errorf("failed to get PKCS#11 PIN: %w", err)
+		}
+		if err := ctx.Login(session, pkcs11.CKU_USER, string(pin)); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			ctx.CloseSession(session)
+			return nil, fmt.Errorf("PKCS#11 login failed: %w", err)
+		}
+	}
+
+	signer, err := s.findKey(ctx, session)
+	if err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+	s.signer = signer
+	return signer, nil
+}
+
+// pkcs11Module loads and initializes a PKCS#11 module once
+func pkcs11Module(module string) (*pkcs11.Ctx, error) {
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+	if ctx := pkcs11Modules[module]; ctx != nil {
+		return ctx, nil
+	}
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module %s: %w", module, err)
+	}
+	pkcs11Modules[module] = ctx
+	return ctx, nil
+}
+
+// findSlot returns the slot matching slot-id or the token label
+func (s *pkcs11KeySource) findSlot(ctx *pkcs11.Ctx) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		if s.slot != "" && s.slot != strconv.FormatUint(uint64(slot), 10) {
+			continue
+		}
+		if s.token != "" {
+			info, err := ctx.GetTokenInfo(slot)
+			if err != nil || strings.TrimRight(info.Label, " \x00") != s.token {
+				continue
+			}
+		}
+		return slot, nil
+	}
+	return 0, fmt.Errorf("no PKCS#11 token matches %s", s.uri)
+}
+
+// findObject returns the single object of a class matching object and id
+func (s *pkcs11KeySource) findObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if s.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, s.object))
+	}
+	if s.id != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(s.id)))
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("PKCS#11 search failed: %w", err)
+	}
+	objects, _, err := ctx.FindObjects(session, 2)
+	ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, fmt.Errorf("PKCS#11 search failed: %w", err)
+	}
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("%d PKCS#11 objects match %s, expected one", len(objects), s.uri)
+	}
+	return objects[0], nil
+}
+
+// findKey finds the private key and reads its public half
+func (s *pkcs11KeySource) findKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) (*pkcs11Signer, error) {
+	priv, err := s.findObject(ctx, session, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := ctx.GetAttributeValue(session, priv, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PKCS#11 key type: %w", err)
+	}
+	keyType := ulongValue(attrs[0].Value)
+
+	pubObj, err := s.findObject(ctx, session, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, fmt.Errorf("public key not found: %w", err)
+	}
+
+	var pub crypto.PublicKey
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := ctx.GetAttributeValue(session, pubObj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RSA public key: %w", err)
+		}
+		pub = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}
+	case pkcs11.CKK_EC:
+		attrs, err := ctx.GetAttributeValue(session, pubObj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EC public key: %w", err)
+		}
+		if pub, err = parseECPoint(attrs[0].Value, attrs[1].Value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#11 key type %d (RSA and ECDSA are supported)", keyType)
+	}
+
+	return &pkcs11Signer{ctx: ctx, session: session, key: priv, pub: pub}, nil
+}
+
+// ulongValue decodes a CK_ULONG attribute, stored in native byte order
+func ulongValue(b []byte) uint {
+	switch len(b) {
+	case 8:
+		return uint(binary.NativeEndian.Uint64(b))
+	case 4:
+		return uint(binary.NativeEndian.Uint32(b))
+	default:
+		return ^uint(0)
+	}
+}
+
+// parseECPoint builds an ECDSA public key from CKA_EC_PARAMS and CKA_EC_POINT
+func parseECPoint(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("unsupported EC parameters: %w", err)
+	}
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidCurveP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidCurveP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidCurveP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+	// The point is DER wrapped in an OCTET STRING by most modules
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+		raw = point
+	}
+	return ecdsa.ParseUncompressedPublicKey(curve, raw)
+}
+
+// pkcs11Signer signs with a key that never leaves the token
+// A PKCS#11 session handles one operation at a time
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+// Public returns the public key
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs a digest with ECDSA, RSA PKCS#1 v1.5 or RSA-PSS
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	message := digest
+	switch s.pub.(type) {
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	case *rsa.PublicKey:
+		hash := opts.HashFunc()
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			mechs, ok := pssMechanisms[hash]
+			if !ok {
+				return nil, fmt.Errorf("unsupported PSS hash %s", hash)
+			}
+			saltLength := pss.SaltLength
+			if saltLength <= 0 {
+				saltLength = hash.Size()
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(mechs[0], mechs[1], uint(saltLength)))
+		} else {
+			prefix, ok := digestInfoPrefixes[hash]
+			if !ok {
+				return nil, fmt.Errorf("unsupported RSA hash %s", hash)
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			message = append(append([]byte{}, prefix...), digest...)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.key); err != nil {
+		return nil, fmt.Errorf("PKCS#11 sign failed: %w", err)
+	}
+	sig, err := s.ctx.Sign(s.session, message)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 sign failed: %w", err)
+	}
+
+	// PKCS#11 returns ECDSA signatures as r || s, TLS expects ASN.1
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// Path is empty, a key in a token cannot change
+func (s *pkcs11KeySource) Path() string {
+	return ""
+}
+
+// String describes the key without the PIN
+func (s *pkcs11KeySource) String() string {
+	label := s.object
+	if label == "" {
+		label = "id " + s.id
+	}
+	return fmt.Sprintf("pkcs11 %s in %s", label, s.module)
+}
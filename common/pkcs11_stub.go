@@ -0,0 +1,11 @@
+//go:build !pkcs11
+
+package common
+
+import "errors"
+
+// newPKCS11KeySource reports that PKCS#11 support was not compiled in
+// It needs cgo and the pkcs11 build tag: go build -tags pkcs11
+func newPKCS11KeySource(string, Passphrase) (KeySource, error) {
+	return nil, errors.New("PKCS#11 keys need a build with -tags pkcs11")
+}
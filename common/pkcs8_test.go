@@ -0,0 +1,126 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// staticPassphrase returns a passphrase source for a fixed value
+func staticPassphrase(s string) Passphrase {
+	return func() ([]byte, error) { return []byte(s), nil }
+}
+
+func TestEncryptPKCS8RoundTrip(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted, err := EncryptPKCS8(der, []byte("s3cret"))
+			if err != nil {
+				t.Fatalf("EncryptPKCS8: %v", err)
+			}
+
+			decrypted, err := DecryptPKCS8(encrypted, []byte("s3cret"))
+			if err != nil {
+				t.Fatalf("DecryptPKCS8: %v", err)
+			}
+			if string(decrypted) != string(der) {
+				t.Fatal("decrypted key differs from the original")
+			}
+
+			data := pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted})
+			signer, err := ParsePrivateKeyPEM(data, staticPassphrase("s3cret"))
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyPEM: %v", err)
+			}
+			if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Fatal("parsed key does not match the original")
+			}
+		})
+	}
+}
+
+func TestParseEncryptedKeyWrongPassphrase(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := WriteKey(path, key, staticPassphrase("right")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong passphrase fails on the padding or, rarely, on the decrypted key
+	if _, err := ParsePrivateKeyPEM(data, staticPassphrase("wrong")); err == nil {
+		t.Fatal("key decrypted with a wrong passphrase")
+	}
+	if _, err := ParsePrivateKeyPEM(data, nil); err == nil {
+		t.Fatal("encrypted key parsed without a passphrase")
+	}
+	if _, err := ParsePrivateKeyPEM(data, staticPassphrase("right")); err != nil {
+		t.Fatalf("ParsePrivateKeyPEM: %v", err)
+	}
+}
+
+// The fixtures were made with:
+//
+//	openssl genpkey -algorithm ec -pkeyopt ec_paramgen_curve:P-256 -out pkcs8-plain.pem
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -passout pass:correct-horse -in pkcs8-plain.pem -out pkcs8-aes256.pem
+//	openssl pkcs8 -topk8 -v2 aes-128-cbc -v2prf hmacWithSHA1 -passout pass:correct-horse -in pkcs8-plain.pem -out pkcs8-aes128-sha1.pem
+func TestDecryptOpenSSLKey(t *testing.T) {
+	plain, err := os.ReadFile("testdata/pkcs8-plain.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ParsePrivateKeyPEM(plain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"pkcs8-aes256.pem", "pkcs8-aes128-sha1.pem"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := ParsePrivateKeyPEM(data, staticPassphrase("correct-horse"))
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyPEM: %v", err)
+			}
+			if !key.Public().(*ecdsa.PublicKey).Equal(want.Public()) {
+				t.Fatal("decrypted key does not match the plain key")
+			}
+			if _, err := ParsePrivateKeyPEM(data, staticPassphrase("wrong")); err == nil {
+				t.Fatal("key decrypted with a wrong passphrase")
+			}
+		})
+	}
+}
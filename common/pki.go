@@ -0,0 +1,522 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crlValidity is how long a CRL stays current
+const crlValidity = 365 * 24 * time.Hour
+
+// Certificate types recorded in the index
+const (
+	CertTypeServer       = "server"
+	CertTypeClient       = "client"
+	CertTypeIntermediate = "intermediate"
+)
+
+// IndexEntry records a certificate issued by the CA
+type IndexEntry struct {
+	Serial    string     `json:"serial"`
+	Type      string     `json:"type"`
+	Name      string     `json:"name"`
+	NotAfter  time.Time  `json:"not_after"`
+	CertFile  string     `json:"cert_file"`
+	KeyFile   string     `json:"key_file"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RenewedBy string     `json:"renewed_by,omitempty"`
+}
+
+// Status returns the human readable status of the certificate
+func (e IndexEntry) Status(now time.Time) string {
+	switch {
+	case e.RevokedAt != nil:
+		return "revoked"
+	case e.RenewedBy != "":
+		return "renewed"
+	case now.After(e.NotAfter):
+		return "expired"
+	default:
+		return "valid"
+	}
+}
+
+// Active checks if the certificate is neither revoked nor replaced
+func (e IndexEntry) Active() bool {
+	return e.RevokedAt == nil && e.RenewedBy == ""
+}
+
+// Index is the on-disk record of issued certificates
+type Index struct {
+	CRLNumber int64        `json:"crl_number"`
+	Certs     []IndexEntry `json:"certs"`
+}
+
+// storeLockFile is locked while the index or the enrollment tokens are
+// updated, so utils and a running server do not overwrite each other
+const storeLockFile = ".lock"
+
+// CertStore manages the CA, issued certificates and the index in a directory
+// The mutex serializes updates within the process, the store lock file
+// across processes
+type CertStore struct {
+	mu         sync.Mutex
+	dir        string
+	passphrase Passphrase
+}
+
+// NewCertStore creates a store rooted at dir
+func NewCertStore(dir string) *CertStore {
+	return &CertStore{dir: dir}
+}
+
+// SetPassphrase sets the passphrase of the store's CA key, used to encrypt
+// a new CA key and to decrypt an existing one
+func (s *CertStore) SetPassphrase(passphrase Passphrase) {
+	s.passphrase = passphrase
+}
+
+// Dir returns the store directory
+func (s *CertStore) Dir() string {
+	return s.dir
+}
+
+// Path returns a path inside the store directory
+func (s *CertStore) Path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// HasCA checks if the CA certificate and a key to issue with exist
+// The root key may be offline when an intermediate CA issues instead
+func (s *CertStore) HasCA() bool {
+	_, certErr := os.Stat(s.Path("ca.pem"))
+	_, keyErr := os.Stat(s.Path("ca-key.pem"))
+	return certErr == nil && (keyErr == nil || s.HasIntermediate())
+}
+
+// HasIntermediate checks if an intermediate CA issues the certificates
+func (s *CertStore) HasIntermediate() bool {
+	_, certErr := os.Stat(s.Path("intermediate.pem"))
+	_, keyErr := os.Stat(s.Path("intermediate-key.pem"))
+	return certErr == nil && keyErr == nil
+}
+
+// InitCA creates a new self-signed CA
+func (s *CertStore) InitCA(commonName, keyAlgorithm string, days int) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	key, err := GenerateKey(keyAlgorithm)
+	if err != nil {
+		return err
+	}
+	serial, err := NewSerial()
+	if err != nil {
+		return err
+	}
+
+	ca := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	if err := WriteKey(s.Path("ca-key.pem"), key, s.passphrase); err != nil {
+		return err
+	}
+	if err := WritePem(s.Path("ca.pem"), "CERTIFICATE", caBytes); err != nil {
+		return err
+	}
+
+	// A new CA starts with a fresh index and an empty CRL
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx := &Index{}
+	if err := s.WriteCRL(idx); err != nil {
+		return err
+	}
+	return s.SaveIndex(idx)
+}
+
+// InitIntermediate creates an intermediate CA signed by the root in another
+// store, so the root key can be kept offline
+// The root certificate is copied as ca.pem, the trust anchor peers are given
+func (s *CertStore) InitIntermediate(root *CertStore, commonName, keyAlgorithm string, days int) error {
+	rootCert, rootKey, err := root.LoadRoot()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	key, err := GenerateKey(keyAlgorithm)
+	if err != nil {
+		return err
+	}
+	serial, err := NewSerial()
+	if err != nil {
+		return err
+	}
+
+	// The intermediate may only issue leaf certificates
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	if template.NotAfter.After(rootCert.NotAfter) {
+		template.NotAfter = rootCert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, rootCert, key.Public(), rootKey)
+	if err != nil {
+		return fmt.Errorf("failed to create intermediate certificate: %w", err)
+	}
+
+	if err := WriteKey(s.Path("intermediate-key.pem"), key, s.passphrase); err != nil {
+		return err
+	}
+	if err := WritePem(s.Path("intermediate.pem"), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	if filepath.Clean(s.dir) != filepath.Clean(root.dir) {
+		if err := WritePem(s.Path("ca.pem"), "CERTIFICATE", rootCert.Raw); err != nil {
+			return err
+		}
+	}
+
+	// The root keeps a record of its intermediates
+	if err := root.Record(IndexEntry{
+		Serial:   serial.Text(16),
+		Type:     CertTypeIntermediate,
+		Name:     commonName,
+		NotAfter: template.NotAfter,
+		CertFile: s.Path("intermediate.pem"),
+		KeyFile:  s.Path("intermediate-key.pem"),
+	}, ""); err != nil {
+		return err
+	}
+
+	// From now on the intermediate signs the CRL, certificates already in
+	// the index stay valid since they chain to the same root
+	return s.UpdateIndex(s.WriteCRL)
+}
+
+// LoadCA loads the issuing CA and its signing key: the intermediate CA if
+// there is one, otherwise the root
+func (s *CertStore) LoadCA() (*x509.Certificate, crypto.Signer, error) {
+	if s.HasIntermediate() {
+		return loadSigner(s.Path("intermediate.pem"), FileKey(s.Path("intermediate-key.pem"), s.passphrase))
+	}
+	return s.LoadRoot()
+}
+
+// LoadRoot loads the root CA certificate and its signing key
+func (s *CertStore) LoadRoot() (*x509.Certificate, crypto.Signer, error) {
+	cert, key, err := loadSigner(s.Path("ca.pem"), FileKey(s.Path("ca-key.pem"), s.passphrase))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA in %s (run 'go run ./utils init-ca' first): %w", s.dir, err)
+	}
+	return cert, key, nil
+}
+
+// loadSigner loads a CA certificate and its key
+func loadSigner(certPath string, key KeySource) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := LoadCertKeyPair(certPath, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair.Leaf, pair.PrivateKey.(crypto.Signer), nil
+}
+
+// EncodeChain returns a certificate as PEM followed by the intermediate CA,
+// the full chain a peer needs to verify it against the root alone
+func (s *CertStore) EncodeChain(der []byte) ([]byte, error) {
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if !s.HasIntermediate() {
+		return chain, nil
+	}
+	intermediate, err := os.ReadFile(s.Path("intermediate.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read intermediate CA: %w", err)
+	}
+	return append(chain, intermediate...), nil
+}
+
+// LoadIndex reads the index, a missing index is empty
+func (s *CertStore) LoadIndex() (*Index, error) {
+	data, err := os.ReadFile(s.Path("index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Index{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %w", err)
+	}
+	return &idx, nil
+}
+
+// SaveIndex writes the index atomically
+// Callers changing an index they loaded hold the store lock, see UpdateIndex
+func (s *CertStore) SaveIndex(idx *Index) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.Path("index.json"), append(data, '\n'), 0600)
+}
+
+// UpdateIndex loads the index, applies update and saves it, holding the
+// store lock so concurrent updates from other processes are not lost
+// Nothing is saved if update fails
+func (s *CertStore) UpdateIndex(update func(*Index) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx, err := s.LoadIndex()
+	if err != nil {
+		return err
+	}
+	if err := update(idx); err != nil {
+		return err
+	}
+	return s.SaveIndex(idx)
+}
+
+// lock takes the store mutex and the store lock file
+func (s *CertStore) lock() (func(), error) {
+	s.mu.Lock()
+	unlock, err := lockFile(s.Path(storeLockFile))
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.mu.Unlock()
+	}, nil
+}
+
+// Find returns the index entry matching a serial or, failing that, the
+// active certificate with the given name
+func (idx *Index) Find(serial, name string) (*IndexEntry, error) {
+	for i := range idx.Certs {
+		e := &idx.Certs[i]
+		if serial != "" && e.Serial == serial {
+			return e, nil
+		}
+		if serial == "" && name != "" && e.Name == name && e.Active() {
+			return e, nil
+		}
+	}
+	if serial != "" {
+		return nil, fmt.Errorf("no certificate with serial %s", serial)
+	}
+	return nil, fmt.Errorf("no active certificate named '%s'", name)
+}
+
+// WriteCRL signs a CRL listing every revoked certificate
+func (s *CertStore) WriteCRL(idx *Index) error {
+	ca, key, err := s.LoadCA()
+	if err != nil {
+		return err
+	}
+
+	var entries []x509.RevocationListEntry
+	for _, e := range idx.Certs {
+		if e.RevokedAt == nil {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(e.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial %s in index", e.Serial)
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *e.RevokedAt,
+		})
+	}
+
+	idx.CRLNumber++
+	now := time.Now()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(idx.CRLNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, ca, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CRL: %w", err)
+	}
+	return WritePem(s.Path("crl.pem"), "X509 CRL", crl)
+}
+
+// NewSerial returns a random 128-bit serial number
+func NewSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// Sign creates a certificate for a public key, signed by the issuing CA
+// The validity is capped at the issuing CA's own expiry
+func (s *CertStore) Sign(template *x509.Certificate, pub crypto.PublicKey, days int) ([]byte, error) {
+	ca, caKey, err := s.LoadCA()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	template.KeyUsage = leafKeyUsage(pub)
+	template.NotBefore = time.Now()
+	template.NotAfter = time.Now().AddDate(0, 0, days)
+	if template.NotAfter.After(ca.NotAfter) {
+		template.NotAfter = ca.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return der, nil
+}
+
+// Record adds an issued certificate to the index
+// The certificate with the serial in replaces, or else active certificates
+// of the same identity stored in the same file, are marked as renewed
+func (s *CertStore) Record(entry IndexEntry, replaces string) error {
+	return s.UpdateIndex(func(idx *Index) error {
+		idx.Add(entry, replaces)
+		return nil
+	})
+}
+
+// Add appends an issued certificate to a loaded index, see Record
+func (idx *Index) Add(entry IndexEntry, replaces string) {
+	for i := range idx.Certs {
+		e := &idx.Certs[i]
+		if replaces != "" {
+			if e.Serial == replaces && e.RenewedBy == "" {
+				e.RenewedBy = entry.Serial
+			}
+			continue
+		}
+		if e.Active() && e.Type == entry.Type && e.Name == entry.Name && e.CertFile == entry.CertFile {
+			e.RenewedBy = entry.Serial
+		}
+	}
+	idx.Certs = append(idx.Certs, entry)
+}
+
+// clientNameRegex restricts client names to safe directory names
+var clientNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// ClientTemplate returns the certificate template of a client identity
+// uri optionally adds a URI SAN, which the server prefers over the CN
+// A spiffe:// URI must be a valid SPIFFE ID
+func ClientTemplate(name, uri string) (*x509.Certificate, error) {
+	if !clientNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid client name '%s' (letters, digits, '.', '_' and '-')", name)
+	}
+
+	var uris []*url.URL
+	switch {
+	case IsSPIFFEID(uri):
+		u, _, err := ParseSPIFFEID(uri)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, u)
+	case uri != "":
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("invalid URI '%s', expected scheme://...", uri)
+		}
+		uris = append(uris, u)
+	}
+
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		URIs:        uris,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil
+}
+
+// WritePem writes a single PEM block, keys are only readable by the owner
+func WritePem(filename, typeStr string, bytes []byte) error {
+	mode := os.FileMode(0644)
+	if strings.Contains(typeStr, "PRIVATE KEY") {
+		mode = 0600
+	}
+	return WriteFileAtomic(filename, pem.EncodeToMemory(&pem.Block{Type: typeStr, Bytes: bytes}), mode)
+}
+
+// WriteFileAtomic writes a file through a temporary file and a rename, so
+// readers never see a partially written certificate or key
+func WriteFileAtomic(filename string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
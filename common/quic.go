@@ -0,0 +1,142 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC constants
+const (
+	QUICProtocol         = "z44" // ALPN protocol of QUIC tunnel connections
+	QUICMaxStreams       = 1024  // Maximum concurrent streams opened by the peer
+	quicHandshakeTimeout = 10 * time.Second
+)
+
+// QUICConfig returns a configured QUIC config
+// Dead peers are detected after keepAlive plus writeTimeout without traffic,
+// matching the yamux keepalive behavior
+func QUICConfig(keepAlive, writeTimeout time.Duration) *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicHandshakeTimeout,
+		MaxIdleTimeout:       keepAlive + writeTimeout,
+		KeepAlivePeriod:      keepAlive,
+		MaxIncomingStreams:   QUICMaxStreams,
+	}
+}
+
+// QUICSession adapts a QUIC connection to the Session interface
+// Every tunnel stream maps to a native QUIC stream
+type QUICSession struct {
+	conn    *quic.Conn
+	streams atomic.Int64
+}
+
+// NewQUICSession wraps an established QUIC connection
+func NewQUICSession(conn *quic.Conn) *QUICSession {
+	return &QUICSession{conn: conn}
+}
+
+// Open opens a new stream
+func (s *QUICSession) Open() (net.Conn, error) {
+	stream, err := s.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(stream), nil
+}
+
+// Accept waits for the peer to open a stream
+func (s *QUICSession) Accept() (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		if s.IsClosed() {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return s.wrap(stream), nil
+}
+
+// Close closes the connection and all its streams
+func (s *QUICSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+// IsClosed checks if the connection is closed
+func (s *QUICSession) IsClosed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+// CloseChan returns a channel closed when the connection closes
+func (s *QUICSession) CloseChan() <-chan struct{} {
+	return s.conn.Context().Done()
+}
+
+// NumStreams returns the number of open streams
+func (s *QUICSession) NumStreams() int {
+	return int(s.streams.Load())
+}
+
+// wrap turns a QUIC stream into a net.Conn and counts it until it ends
+// The send direction finishes when we close the stream, the peer stops
+// reading or resets it, or the connection closes, so streams a caller never
+// closes still stop counting
+func (s *QUICSession) wrap(stream *quic.Stream) net.Conn {
+	s.streams.Add(1)
+	qs := &quicStream{Stream: stream, session: s}
+	go func() {
+		<-stream.Context().Done()
+		qs.release()
+	}()
+	return qs
+}
+
+// quicStream is a QUIC stream with the net.Conn address methods
+type quicStream struct {
+	*quic.Stream
+	session  *QUICSession
+	once     sync.Once
+	released sync.Once
+}
+
+// release removes the stream from the session's count, once
+func (s *quicStream) release() {
+	s.released.Do(func() { s.session.streams.Add(-1) })
+}
+
+// LocalAddr returns the local address of the QUIC connection
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the QUIC connection
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+// CloseWrite finishes the send direction, the peer reads EOF
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close stops both directions of the stream
+// quic.Stream.Close only finishes the send direction
+func (s *quicStream) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.release()
+		s.CancelRead(0)
+		// A peer that stopped reading already reset our send direction
+		canceled := s.Context().Err() != nil
+		if err = s.Stream.Close(); canceled {
+			err = nil
+		}
+	})
+	return err
+}
@@ -0,0 +1,223 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// loopbackCertificate returns a self-signed certificate for 127.0.0.1
+func loopbackCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "z44-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// quicLoopback opens a QUIC session over loopback and returns both ends
+func quicLoopback(t *testing.T) (client, server *QUICSession) {
+	t.Helper()
+	cert := loopbackCertificate(t)
+	config := QUICConfig(time.Second, 5*time.Second)
+
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{QUICProtocol},
+		MinVersion:   tls.VersionTLS13,
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan *quic.Conn, 1)
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "127.0.0.1",
+		NextProtos: []string{QUICProtocol},
+		MinVersion: tls.VersionTLS13,
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.FailNow()
+	}
+	client, server = NewQUICSession(conn), NewQUICSession(serverConn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestQUICSessionParallelStreams(t *testing.T) {
+	client, server := quicLoopback(t)
+
+	// The server echoes every stream until the client half-closes it
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer CloseConn(c)
+				io.Copy(c, c)
+				CloseWrite(c)
+			}(stream)
+		}
+	}()
+
+	const streams = 2
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	started := make(chan struct{})
+	counted := make(chan struct{})
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer CloseConn(stream)
+
+			// Both streams are open before either finishes
+			started <- struct{}{}
+			<-counted
+			payload := bytes.Repeat([]byte{byte('a' + i)}, 256*1024)
+			go func() {
+				stream.Write(payload)
+				CloseWrite(stream)
+			}()
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				errs <- fmt.Errorf("stream %d: %w", i, err)
+				return
+			}
+			if !bytes.Equal(got, payload) {
+				errs <- fmt.Errorf("stream %d: echoed %d bytes, want %d", i, len(got), len(payload))
+			}
+		}()
+	}
+	for range streams {
+		<-started
+	}
+	if n := client.NumStreams(); n != streams {
+		t.Errorf("client has %d open streams, want %d", n, streams)
+	}
+	close(counted)
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("client has %d open streams after closing them, want 0", n)
+	}
+}
+
+func TestQUICSessionPeerReset(t *testing.T) {
+	client, server := quicLoopback(t)
+
+	// The server resets both directions of the stream without closing it
+	go func() {
+		stream, err := server.Accept()
+		if err != nil {
+			return
+		}
+		qs := stream.(*quicStream)
+		qs.CancelRead(1)
+		qs.CancelWrite(1)
+	}()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream is never closed on our side, yet stops counting
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 0 || server.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("reset stream still counted: client %d, server %d", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	CloseConn(stream)
+	if n := client.NumStreams(); n != 0 {
+		t.Fatalf("closing a reset stream left %d open streams, want 0", n)
+	}
+}
+
+func TestQUICSessionClose(t *testing.T) {
+	client, server := quicLoopback(t)
+
+	client.Close()
+	select {
+	case <-server.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not notice the closed session")
+	}
+	if !client.IsClosed() || !server.IsClosed() {
+		t.Fatal("session not reported as closed")
+	}
+	if _, err := server.Accept(); err != io.EOF {
+		t.Fatalf("Accept on a closed session returned %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// KeyedRateLimiter keeps a token bucket per key, such as a port or a source IP
+// At most maxKeys buckets are kept, the least recently used one is dropped
+// to make room. A dropped key starts over with a full bucket, which is what
+// an idle key would have anyway
+type KeyedRateLimiter struct {
+	mu         sync.Mutex
+	maxTokens  int
+	refillRate time.Duration
+	maxKeys    int
+	buckets    map[string]*list.Element
+	order      *list.List // Most recently used first
+}
+
+// keyedBucket is an entry of the LRU list
+type keyedBucket struct {
+	key     string
+	limiter *RateLimiter
+}
+
+// NewKeyedRateLimiter creates a keyed rate limiter
+// maxTokens and refillRate apply to every key like in NewRateLimiter
+// maxKeys bounds the number of buckets kept in memory
+func NewKeyedRateLimiter(maxTokens int, refillRate time.Duration, maxKeys int) *KeyedRateLimiter {
+	return &KeyedRateLimiter{
+		maxTokens:  maxTokens,
+		refillRate: refillRate,
+		maxKeys:    maxKeys,
+		buckets:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Allow checks if a token is available for a key and consumes it
+func (k *KeyedRateLimiter) Allow(key string) bool {
+	return k.Limiter(key).Allow()
+}
+
+// Limiter returns the bucket of a key, creating a full one if needed
+func (k *KeyedRateLimiter) Limiter(key string) *RateLimiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var limiter *RateLimiter
+	if e, ok := k.buckets[key]; ok {
+		k.order.MoveToFront(e)
+		limiter = e.Value.(*keyedBucket).limiter
+	} else {
+		if k.order.Len() >= k.maxKeys {
+			oldest := k.order.Back()
+			k.order.Remove(oldest)
+			delete(k.buckets, oldest.Value.(*keyedBucket).key)
+		}
+		limiter = NewRateLimiter(k.maxTokens, k.refillRate)
+		k.buckets[key] = k.order.PushFront(&keyedBucket{key: key, limiter: limiter})
+	}
+	return limiter
+}
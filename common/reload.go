@@ -0,0 +1,241 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CertReloader holds a certificate, its key and the CA bundle, and reloads
+// them when the files change so certificates rotate without a restart
+type CertReloader struct {
+	certPath string
+	key      KeySource
+	caPath   string
+
+	mu            sync.RWMutex
+	cert          *tls.Certificate
+	chain         []*x509.Certificate // Intermediate CAs sent after the certificate
+	caPool        *x509.CertPool      // Trust anchors of the CA bundle
+	intermediates *x509.CertPool      // Intermediate CAs of the bundle and our own chain
+	caCerts       []*x509.Certificate
+	mods          [3]time.Time
+}
+
+// NewCertReloader loads the certificate, key and CA bundle
+// An empty certPath holds only a CA bundle, an empty caPath only a certificate
+func NewCertReloader(certPath string, key KeySource, caPath string) (*CertReloader, error) {
+	r := &CertReloader{certPath: certPath, key: key, caPath: caPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTimes returns the modification times of the watched files
+// A key that is not a file is never seen as changed
+func (r *CertReloader) modTimes() [3]time.Time {
+	var mods [3]time.Time
+	var keyPath string
+	if r.key != nil {
+		keyPath = r.key.Path()
+	}
+	for i, path := range []string{r.certPath, keyPath, r.caPath} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			mods[i] = info.ModTime()
+		}
+	}
+	return mods
+}
+
+// Reload reads all files again
+// On error the previous certificate and CA bundle stay in use
+func (r *CertReloader) Reload() error {
+	mods := r.modTimes()
+
+	var cert tls.Certificate
+	var chain []*x509.Certificate
+	var err error
+	if r.certPath != "" {
+		cert, err = LoadCertKeyPair(r.certPath, r.key)
+		if err == nil {
+			err = CheckValidity(r.certPath, cert.Leaf)
+		}
+		if err == nil {
+			chain, err = parseChain(r.certPath, cert.Certificate[1:])
+		}
+	}
+	var caCerts []*x509.Certificate
+	if err == nil && r.caPath != "" {
+		caCerts, err = LoadCACerts(r.caPath)
+	}
+	if err == nil {
+		err = checkCAValidity(r.caPath, caCerts)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Remember the files even when they are broken, a half written rotation
+	// is retried once the remaining files change
+	r.mods = mods
+	if err != nil {
+		return err
+	}
+
+	roots, intermediates := SplitCABundle(caCerts)
+	for _, ca := range chain {
+		intermediates.AddCert(ca)
+	}
+	r.cert, r.chain, r.caPool, r.intermediates, r.caCerts = &cert, chain, roots, intermediates, caCerts
+	r.recordExpiry()
+	return nil
+}
+
+// parseChain parses the intermediate CAs that follow a certificate in its
+// file, an expired intermediate breaks the chain for every peer
+func parseChain(path string, raw [][]byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for _, der := range raw {
+		ca, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse chain of %s: %w", path, err)
+		}
+		if err := CheckValidity(path, ca); err != nil {
+			return nil, err
+		}
+		chain = append(chain, ca)
+	}
+	return chain, nil
+}
+
+// checkCAValidity requires at least one usable CA in the bundle
+// Expired CAs may remain in a bundle during rotation
+func checkCAValidity(path string, caCerts []*x509.Certificate) error {
+	var err error
+	for _, ca := range caCerts {
+		if err = CheckValidity(path, ca); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// CheckExpiry publishes the expiry of the certificate and CA bundle and warns
+// about certificates close to expiring
+func (r *CertReloader) CheckExpiry() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.recordExpiry()
+}
+
+// recordExpiry records expiry metrics, the caller holds the lock
+func (r *CertReloader) recordExpiry() {
+	if r.cert.Leaf != nil {
+		RecordExpiry("own", r.cert.Leaf)
+	}
+	for _, ca := range slices.Concat(r.chain, r.caCerts) {
+		RecordExpiry("ca/"+ca.Subject.CommonName, ca)
+	}
+}
+
+// ReloadIfChanged reloads when any file was modified and reports whether it did
+func (r *CertReloader) ReloadIfChanged() (bool, error) {
+	r.mu.RLock()
+	unchanged := r.mods == r.modTimes()
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	if err := r.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Certificate returns the current certificate
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// CAPool returns the current CA pool
+func (r *CertReloader) CAPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.caPool
+}
+
+// CACerts returns the certificates of the current CA bundle
+func (r *CertReloader) CACerts() []*x509.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.caCerts
+}
+
+// Issuers returns every CA that may sign certificates and CRLs: the CA bundle
+// and the intermediate CAs of our own chain
+func (r *CertReloader) Issuers() []*x509.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Concat(r.caCerts, r.chain)
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// VerifyClientChain verifies a client certificate chain against the current CA pool
+// It replaces the built-in check so a rotated CA bundle applies to new handshakes
+func (r *CertReloader) VerifyClientChain(rawCerts [][]byte) ([][]*x509.Certificate, error) {
+	return r.verifyChain(rawCerts, "", x509.ExtKeyUsageClientAuth)
+}
+
+// VerifyServerChain verifies a server certificate chain and name against the
+// current CA pool, completing the chain with intermediates of the CA bundle
+func (r *CertReloader) VerifyServerChain(rawCerts [][]byte, serverName string) ([][]*x509.Certificate, error) {
+	return r.verifyChain(rawCerts, serverName, x509.ExtKeyUsageServerAuth)
+}
+
+// verifyChain verifies a peer chain, the peer's own intermediates are
+// combined with the known ones so either side may hold them
+func (r *CertReloader) verifyChain(rawCerts [][]byte, dnsName string, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("no peer certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse peer certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	r.mu.RLock()
+	roots, intermediates := r.caPool, r.intermediates.Clone()
+	r.mu.RUnlock()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(x509.VerifyOptions{
+		DNSName:       dnsName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+}
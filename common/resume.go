@@ -0,0 +1,590 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable stream constants
+const (
+	ResumeBufferSize   = 1 << 20         // Maximum unacknowledged bytes kept for replay
+	resumeMaxFrameSize = 32 << 10        // Maximum payload of a single data frame
+	resumeAckThreshold = 32 << 10        // Acknowledge after this many received bytes
+	resumeCloseTimeout = 5 * time.Second // Bound on flushing the final frame at close
+	maxLineLength      = 256             // Maximum length of a control line
+)
+
+// Resumable stream frame types
+const (
+	frameData byte = 1
+	frameAck  byte = 2
+	frameFin  byte = 3
+)
+
+// ErrResumeExpired is returned once a detached stream was not resumed in time
+var ErrResumeExpired = errors.New("resumable stream expired")
+
+// ResumableConn is a net.Conn carried over a replaceable transport stream
+// Written bytes are kept until the peer acknowledges them so they can be
+// replayed after the transport is swapped by Attach
+type ResumableConn struct {
+	id       uint64
+	window   time.Duration
+	onDetach func(*ResumableConn)
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn // nil while detached
+	gen     uint64   // incremented on every attach
+	closed  bool
+	expired bool
+	finSent bool // CloseWrite was called, the FIN follows any replay
+	timer   *time.Timer
+
+	writeMu sync.Mutex // serializes Write calls
+	wmu     sync.Mutex // serializes frames on the transport
+	sent    uint64     // total bytes written
+	acked   uint64     // bytes acknowledged by the peer
+	buf     []byte     // unacknowledged bytes [acked, sent)
+
+	readMu  sync.Mutex // serializes Read calls
+	recvd   uint64     // total bytes received
+	unacked uint64     // bytes received since the last ack
+	eof     bool
+	pending []byte
+	rbuf    []byte
+}
+
+// NewResumableConn wraps an established transport stream
+// onDetach is called in its own goroutine whenever the transport fails
+func NewResumableConn(id uint64, conn net.Conn, window time.Duration, onDetach func(*ResumableConn)) *ResumableConn {
+	c := &ResumableConn{
+		id:       id,
+		window:   window,
+		onDetach: onDetach,
+		conn:     conn,
+		gen:      1,
+		rbuf:     make([]byte, resumeMaxFrameSize),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// ID returns the stream ID shared by both peers
+func (c *ResumableConn) ID() uint64 {
+	return c.id
+}
+
+// Window returns how long a detached stream waits to be resumed
+func (c *ResumableConn) Window() time.Duration {
+	return c.window
+}
+
+// Received returns the number of bytes received from the peer
+func (c *ResumableConn) Received() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recvd
+}
+
+// IsAttached checks if the stream currently has a transport
+func (c *ResumableConn) IsAttached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// IsClosed checks if the stream was closed or expired
+func (c *ResumableConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed || c.expired
+}
+
+// current waits for an attached transport and returns it with its generation
+func (c *ResumableConn) current() (net.Conn, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.conn == nil && !c.closed && !c.expired {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return nil, 0, net.ErrClosed
+	}
+	if c.expired {
+		return nil, 0, ErrResumeExpired
+	}
+	return c.conn, c.gen, nil
+}
+
+// Detach drops the current transport and starts the resume window
+func (c *ResumableConn) Detach() {
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+	c.detach(gen)
+}
+
+// detach drops the transport of the given generation if still attached
+func (c *ResumableConn) detach(gen uint64) {
+	c.mu.Lock()
+	if c.gen != gen || c.conn == nil || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	old := c.conn
+	c.conn = nil
+	c.timer = time.AfterFunc(c.window, c.expire)
+	c.mu.Unlock()
+
+	CloseConn(old)
+	if c.onDetach != nil {
+		go c.onDetach(c)
+	}
+}
+
+// expire gives up on a stream that was not resumed within the window
+func (c *ResumableConn) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil && !c.closed {
+		c.expired = true
+		c.cond.Broadcast()
+	}
+}
+
+// Attach resumes the stream over a new transport
+// peerReceived is the number of bytes the peer already received from us
+func (c *ResumableConn) Attach(conn net.Conn, peerReceived uint64) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.closed || c.expired {
+		c.mu.Unlock()
+		return ErrResumeExpired
+	}
+	if peerReceived < c.acked || peerReceived > c.sent {
+		c.mu.Unlock()
+		return fmt.Errorf("peer offset %d outside replay buffer [%d, %d]", peerReceived, c.acked, c.sent)
+	}
+	c.trim(peerReceived)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	old := c.conn
+	c.conn = conn
+	c.gen++
+	gen := c.gen
+	replay := append([]byte(nil), c.buf...)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if old != nil {
+		CloseConn(old)
+	}
+
+	for len(replay) > 0 {
+		n := min(len(replay), resumeMaxFrameSize)
+		if err := writeDataFrame(conn, replay[:n]); err != nil {
+			c.detach(gen)
+			return nil
+		}
+		replay = replay[n:]
+	}
+	c.mu.Lock()
+	finSent := c.finSent
+	c.mu.Unlock()
+	if finSent {
+		if _, err := conn.Write([]byte{frameFin}); err != nil {
+			c.detach(gen)
+		}
+	}
+	return nil
+}
+
+// trim drops bytes acknowledged by the peer, mu must be held
+func (c *ResumableConn) trim(offset uint64) {
+	if offset <= c.acked {
+		return
+	}
+	c.buf = c.buf[offset-c.acked:]
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+	c.acked = offset
+	c.cond.Broadcast()
+}
+
+// Read reads data frames from the transport, waiting across reconnects
+func (c *ResumableConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if len(c.pending) > 0 {
+			n := copy(b, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		conn, gen, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+
+		typ, payload, offset, err := readFrame(conn, c.rbuf)
+		if err != nil {
+			c.detach(gen)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.conn == nil || c.gen != gen {
+			// Transport was swapped mid-frame, the peer replays it
+			c.mu.Unlock()
+			continue
+		}
+		switch typ {
+		case frameData:
+			c.recvd += uint64(len(payload))
+			c.unacked += uint64(len(payload))
+			c.pending = payload
+		case frameAck:
+			if offset <= c.sent {
+				c.trim(offset)
+			}
+		case frameFin:
+			if !c.eof {
+				c.eof = true
+				go c.drain()
+			}
+		}
+		// Everything is acknowledged at the FIN, so the peer can close
+		needAck := c.unacked >= resumeAckThreshold || (c.eof && c.unacked > 0)
+		recvd := c.recvd
+		if needAck {
+			c.unacked = 0
+		}
+		c.mu.Unlock()
+
+		if needAck {
+			c.sendAck(gen, recvd)
+		}
+	}
+}
+
+// drain keeps reading acknowledgements once the peer sent its FIN and Read
+// returns EOF, so writes in the other direction do not stall on a full
+// replay buffer. It ends when the stream is closed or expires
+func (c *ResumableConn) drain() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in resumable stream drain: %v", r)
+		}
+	}()
+
+	buf := make([]byte, resumeMaxFrameSize)
+	for {
+		conn, gen, err := c.current()
+		if err != nil {
+			return
+		}
+		typ, _, offset, err := readFrame(conn, buf)
+		if err != nil {
+			// Once our FIN was sent and every byte acknowledged, the
+			// peer closing the transport is the end of the stream
+			c.mu.Lock()
+			done := c.finSent && c.acked == c.sent
+			c.mu.Unlock()
+			if done {
+				return
+			}
+			c.detach(gen)
+			continue
+		}
+		c.mu.Lock()
+		if typ == frameAck && c.conn != nil && c.gen == gen && offset <= c.sent {
+			c.trim(offset)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// sendAck acknowledges received bytes to the peer
+func (c *ResumableConn) sendAck(gen, offset uint64) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	conn := c.conn
+	current := c.gen == gen
+	c.mu.Unlock()
+	if conn == nil || !current {
+		return
+	}
+
+	var frame [9]byte
+	frame[0] = frameAck
+	binary.BigEndian.PutUint64(frame[1:], offset)
+	if _, err := conn.Write(frame[:]); err != nil {
+		c.detach(gen)
+	}
+}
+
+// Write buffers data for replay and sends it if a transport is attached
+func (c *ResumableConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), resumeMaxFrameSize)]
+
+		// Wait for the peer to acknowledge enough data to make room
+		c.mu.Lock()
+		for len(c.buf)+len(chunk) > ResumeBufferSize && !c.closed && !c.expired {
+			c.cond.Wait()
+		}
+		if c.closed || c.finSent {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.expired {
+			c.mu.Unlock()
+			return written, ErrResumeExpired
+		}
+		c.mu.Unlock()
+
+		c.wmu.Lock()
+		c.mu.Lock()
+		c.buf = append(c.buf, chunk...)
+		c.sent += uint64(len(chunk))
+		conn, gen := c.conn, c.gen
+		c.mu.Unlock()
+		if conn != nil {
+			if err := writeDataFrame(conn, chunk); err != nil {
+				c.detach(gen)
+			}
+		}
+		c.wmu.Unlock()
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN frame so the peer reads EOF after the data written
+// so far, reading goes on. The FIN is sent again after a replay
+func (c *ResumableConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	if c.finSent {
+		c.mu.Unlock()
+		return nil
+	}
+	c.finSent = true
+	conn, gen := c.conn, c.gen
+	c.mu.Unlock()
+
+	if conn != nil {
+		if _, err := conn.Write([]byte{frameFin}); err != nil {
+			c.detach(gen)
+		}
+	}
+	return nil
+}
+
+// Close sends a FIN frame to the peer and closes the transport
+// After the peer's FIN it first waits up to resumeCloseTimeout for the
+// data written to be acknowledged, as closing a QUIC transport also stops
+// the peer from sending the acknowledgements and reading the rest
+func (c *ResumableConn) Close() error {
+	c.mu.Lock()
+	if c.eof && c.conn != nil && c.acked < c.sent && !c.closed {
+		timedOut := false
+		timer := time.AfterFunc(resumeCloseTimeout, func() {
+			c.mu.Lock()
+			timedOut = true
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		for c.acked < c.sent && !c.closed && !c.expired && !timedOut {
+			c.cond.Wait()
+		}
+		timer.Stop()
+	}
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	c.conn = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	// Unblock a reader waiting for the peer, and a writer stuck on flow
+	// control so the FIN is not delayed forever
+	conn.SetReadDeadline(time.Now())
+	conn.SetWriteDeadline(time.Now().Add(resumeCloseTimeout))
+	c.wmu.Lock()
+	conn.Write([]byte{frameFin})
+	c.wmu.Unlock()
+	return conn.Close()
+}
+
+// LocalAddr returns the local address of the current transport
+func (c *ResumableConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the current transport
+func (c *ResumableConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline is a no-op, deadlines do not survive a transport swap
+func (c *ResumableConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op, deadlines do not survive a transport swap
+func (c *ResumableConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op, deadlines do not survive a transport swap
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// writeDataFrame writes a single data frame
+func writeDataFrame(conn net.Conn, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = frameData
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	_, err := conn.Write(frame)
+	return err
+}
+
+// readFrame reads a single frame, data payloads are read into buf
+func readFrame(conn net.Conn, buf []byte) (byte, []byte, uint64, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(conn, typ[:]); err != nil {
+		return 0, nil, 0, err
+	}
+
+	switch typ[0] {
+	case frameData:
+		var hdr [4]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return 0, nil, 0, err
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n > uint32(len(buf)) {
+			return 0, nil, 0, fmt.Errorf("frame too large: %d bytes", n)
+		}
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return 0, nil, 0, err
+		}
+		return frameData, buf[:n], 0, nil
+	case frameAck:
+		var off [8]byte
+		if _, err := io.ReadFull(conn, off[:]); err != nil {
+			return 0, nil, 0, err
+		}
+		return frameAck, nil, binary.BigEndian.Uint64(off[:]), nil
+	case frameFin:
+		return frameFin, nil, 0, nil
+	default:
+		return 0, nil, 0, fmt.Errorf("unknown frame type %d", typ[0])
+	}
+}
+
+// ReadLine reads a single newline-terminated control line without buffering
+// past it, so frames that follow on the same stream are left untouched
+func ReadLine(conn net.Conn) (string, error) {
+	var sb strings.Builder
+	var b [1]byte
+	for sb.Len() < maxLineLength {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return sb.String(), nil
+		}
+		sb.WriteByte(b[0])
+	}
+	return "", fmt.Errorf("line exceeds %d bytes", maxLineLength)
+}
+
+// ResumeRegistry tracks resumable streams by ID
+type ResumeRegistry struct {
+	mu    sync.Mutex
+	conns map[uint64]*ResumableConn
+}
+
+// NewResumeRegistry creates an empty registry
+func NewResumeRegistry() *ResumeRegistry {
+	return &ResumeRegistry{conns: make(map[uint64]*ResumableConn)}
+}
+
+// Add registers a stream
+func (r *ResumeRegistry) Add(c *ResumableConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.ID()] = c
+}
+
+// Get looks up a stream by ID
+func (r *ResumeRegistry) Get(id uint64) *ResumableConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[id]
+}
+
+// Remove unregisters a stream
+func (r *ResumeRegistry) Remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
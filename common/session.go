@@ -0,0 +1,14 @@
+package common
+
+import "net"
+
+// Session is a multiplexed tunnel connection
+// It is implemented by *yamux.Session and QUICSession
+type Session interface {
+	Open() (net.Conn, error)
+	Accept() (net.Conn, error)
+	Close() error
+	IsClosed() bool
+	CloseChan() <-chan struct{}
+	NumStreams() int
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SPIFFEScheme is the URI scheme of SPIFFE IDs, spiffe://trust-domain/path
+const SPIFFEScheme = "spiffe"
+
+// IsSPIFFEID checks if a URI is meant as a SPIFFE ID
+func IsSPIFFEID(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), SPIFFEScheme+"://")
+}
+
+// ParseSPIFFEID validates a workload SPIFFE ID and returns it with its trust domain
+// Following the SPIFFE spec it has a lowercase trust domain, a non-empty path
+// of plain segments and no port, user info, query or fragment
+func ParseSPIFFEID(id string) (*url.URL, string, error) {
+	rest, ok := strings.CutPrefix(id, SPIFFEScheme+"://")
+	if !ok {
+		return nil, "", fmt.Errorf("invalid SPIFFE ID '%s', expected spiffe://trust-domain/path", id)
+	}
+	td, path, _ := strings.Cut(rest, "/")
+	if err := ValidateTrustDomain(td); err != nil {
+		return nil, "", fmt.Errorf("invalid SPIFFE ID '%s': %w", id, err)
+	}
+	if path == "" {
+		return nil, "", fmt.Errorf("invalid SPIFFE ID '%s': the path is empty", id)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, "", fmt.Errorf("invalid SPIFFE ID '%s': empty, '.' or '..' path segment", id)
+		}
+		if strings.IndexFunc(segment, func(r rune) bool { return !isSPIFFEChar(r, true) }) >= 0 {
+			return nil, "", fmt.Errorf("invalid SPIFFE ID '%s': path segments may only contain letters, digits, '.', '_' and '-'", id)
+		}
+	}
+	return &url.URL{Scheme: SPIFFEScheme, Host: td, Path: "/" + path}, td, nil
+}
+
+// ValidateTrustDomain checks a SPIFFE trust domain name
+func ValidateTrustDomain(td string) error {
+	if td == "" {
+		return fmt.Errorf("the trust domain is empty")
+	}
+	if strings.IndexFunc(td, func(r rune) bool { return !isSPIFFEChar(r, false) }) >= 0 {
+		return fmt.Errorf("trust domain '%s' may only contain lowercase letters, digits, '.', '_' and '-'", td)
+	}
+	return nil
+}
+
+// isSPIFFEChar reports whether a character is allowed in a trust domain or,
+// with upper case letters, in a path segment
+func isSPIFFEChar(r rune, path bool) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		return true
+	case r >= 'A' && r <= 'Z':
+		return path
+	}
+	return false
+}
+
+// SPIFFEName returns the last path segment of a SPIFFE ID, a default client name
+func SPIFFEName(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
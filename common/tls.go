@@ -1,37 +1,112 @@
 package common
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"os"
 )
 
-// LoadCACertPool loads the CA certificate and creates a cert pool
+// LoadCACertPool loads the trust anchors of a CA bundle
+// Intermediate CAs in the bundle are not trusted on their own
 func LoadCACertPool(caPath string) (*x509.CertPool, error) {
-	caCert, err := os.ReadFile(caPath)
+	caCerts, err := LoadCACerts(caPath)
+	if err != nil {
+		return nil, err
+	}
+	roots, _ := SplitCABundle(caCerts)
+	return roots, nil
+}
+
+// SplitCABundle separates the self-signed roots, which are trusted, from the
+// intermediate CAs, which only help to complete chains
+// A bundle without any self-signed certificate trusts all of its certificates
+func SplitCABundle(caCerts []*x509.Certificate) (roots, intermediates *x509.CertPool) {
+	roots, intermediates = x509.NewCertPool(), x509.NewCertPool()
+	hasRoot := false
+	for _, ca := range caCerts {
+		if isSelfSigned(ca) {
+			roots.AddCert(ca)
+			hasRoot = true
+		} else {
+			intermediates.AddCert(ca)
+		}
+	}
+	if !hasRoot {
+		for _, ca := range caCerts {
+			roots.AddCert(ca)
+		}
+	}
+	return roots, intermediates
+}
+
+// isSelfSigned checks if a certificate is a root that signed itself
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// LoadCACerts loads every certificate of a CA bundle
+func LoadCACerts(caPath string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(caPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
 	}
 
-	pool := x509.NewCertPool()
-	if !pool.AppendCertsFromPEM(caCert) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
 		return nil, fmt.Errorf("failed to parse CA certificate")
 	}
-
-	return pool, nil
+	return certs, nil
 }
 
-// LoadCertKeyPair loads a certificate and key pair
-func LoadCertKeyPair(certPath, keyPath string) (tls.Certificate, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+// LoadCertKeyPair loads a certificate and its key from a key source
+// The certificate file may hold the full chain, which is sent to peers
+// Keys may be RSA, ECDSA or Ed25519, in PKCS#8 (optionally encrypted), PKCS#1
+// or SEC 1 form, or live in a PKCS#11 token
+func LoadCertKeyPair(certPath string, keySource KeySource) (tls.Certificate, error) {
+	data, err := os.ReadFile(certPath)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %w", err)
 	}
+	var cert tls.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: no certificate in %s", certPath)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	key, err := keySource.Load()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load key: %w", err)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.Leaf.PublicKey) {
+		return tls.Certificate{}, fmt.Errorf("key %s does not match certificate %s", keySource, certPath)
+	}
+	cert.PrivateKey = key
 	return cert, nil
 }
 
 // GetSecureCipherSuites returns a list of secure cipher suites for TLS 1.2
+// The ECDSA suites also cover Ed25519 certificates
 // TLS 1.3 cipher suites are secure by default and not configurable
 func GetSecureCipherSuites() []uint16 {
 	return []uint16{
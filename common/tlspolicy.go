@@ -0,0 +1,200 @@
+package common
+
+import (
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// TLS profiles
+const (
+	TLSProfileDefault = "default" // TLS 1.2 and 1.3, secure TLS 1.2 suites, Go's key exchanges
+	TLSProfileStrict  = "strict"  // TLS 1.3 only, hybrid post-quantum key exchange first
+)
+
+// tlsVersions maps the version names of a TLS policy
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps the key exchange names of a TLS policy
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768, // Hybrid post-quantum (ML-KEM-768 with X25519)
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// tls13Curves are the key exchanges that only exist in TLS 1.3
+var tls13Curves = map[tls.CurveID]bool{
+	tls.X25519MLKEM768: true,
+}
+
+// TLSPolicy is the "tls" section of the client and server configs
+// Fields left empty take the value of the profile
+type TLSPolicy struct {
+	Profile      string   `json:"profile,omitempty"`       // "default" or "strict"
+	MinVersion   string   `json:"min_version,omitempty"`   // "1.2" or "1.3"
+	MaxVersion   string   `json:"max_version,omitempty"`   // "1.2" or "1.3"
+	CipherSuites []string `json:"cipher_suites,omitempty"` // TLS 1.2 suites, TLS 1.3 suites are not configurable
+	Curves       []string `json:"curves,omitempty"`        // Key exchanges in order of preference
+}
+
+// TLSSettings is a checked TLS policy, ready to apply
+type TLSSettings struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	CipherSuites []uint16
+	Curves       []tls.CurveID // Nil keeps Go's defaults, which include X25519MLKEM768
+}
+
+// Resolve checks the policy and returns the settings it stands for
+func (p TLSPolicy) Resolve() (*TLSSettings, error) {
+	var s TLSSettings
+	switch p.Profile {
+	case "", TLSProfileDefault:
+		s = TLSSettings{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS13, CipherSuites: GetSecureCipherSuites()}
+	case TLSProfileStrict:
+		s = TLSSettings{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13, Curves: []tls.CurveID{tls.X25519MLKEM768, tls.X25519}}
+	default:
+		return nil, fmt.Errorf("unknown profile '%s', expected '%s' or '%s'", p.Profile, TLSProfileDefault, TLSProfileStrict)
+	}
+
+	var err error
+	if p.MinVersion != "" {
+		if s.MinVersion, err = parseTLSVersion(p.MinVersion); err != nil {
+			return nil, fmt.Errorf("min_version: %w", err)
+		}
+	}
+	if p.MaxVersion != "" {
+		if s.MaxVersion, err = parseTLSVersion(p.MaxVersion); err != nil {
+			return nil, fmt.Errorf("max_version: %w", err)
+		}
+	}
+	if s.MinVersion > s.MaxVersion {
+		return nil, fmt.Errorf("min_version %s is above max_version %s", tls.VersionName(s.MinVersion), tls.VersionName(s.MaxVersion))
+	}
+
+	if len(p.CipherSuites) > 0 {
+		if s.MinVersion == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher_suites only apply to TLS 1.2, TLS 1.3 suites are not configurable")
+		}
+		s.CipherSuites = nil
+		for _, name := range p.CipherSuites {
+			id, err := parseCipherSuite(name)
+			if err != nil {
+				return nil, fmt.Errorf("cipher_suites: %w", err)
+			}
+			s.CipherSuites = append(s.CipherSuites, id)
+		}
+	}
+
+	if len(p.Curves) > 0 {
+		s.Curves = nil
+		for _, name := range p.Curves {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return nil, fmt.Errorf("curves: unknown key exchange '%s', expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(tlsCurves)), ", "))
+			}
+			s.Curves = append(s.Curves, id)
+		}
+		if err := s.checkCurves(); err != nil {
+			return nil, fmt.Errorf("curves: %w", err)
+		}
+	}
+	return &s, nil
+}
+
+// checkCurves makes sure every allowed TLS version has a key exchange
+func (s *TLSSettings) checkCurves() error {
+	classical := slices.ContainsFunc(s.Curves, func(c tls.CurveID) bool { return !tls13Curves[c] })
+	if !s.AllowsTLS13() {
+		for _, c := range s.Curves {
+			if tls13Curves[c] {
+				return fmt.Errorf("%s requires TLS 1.3, but max_version is %s", curveName(c), tls.VersionName(s.MaxVersion))
+			}
+		}
+	}
+	if s.MinVersion < tls.VersionTLS13 && !classical {
+		return fmt.Errorf("TLS 1.2 needs a classical key exchange (X25519 or a P curve), add one or set min_version to 1.3")
+	}
+	return nil
+}
+
+// parseTLSVersion parses "1.2" or "1.3"
+func parseTLSVersion(name string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(name), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version '%s', expected 1.2 or 1.3", name)
+	}
+	return v, nil
+}
+
+// parseCipherSuite looks up a secure TLS 1.2 cipher suite by its Go name
+// ChaCha20 suites may also be named without the "_SHA256" suffix, like Go's constants
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name && suite.Name != name+"_SHA256" {
+			continue
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return 0, fmt.Errorf("%s is a TLS 1.3 suite, those are not configurable", name)
+		}
+		return suite.ID, nil
+	}
+	return 0, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+}
+
+// Apply sets the versions, cipher suites and key exchanges of a TLS config
+func (s *TLSSettings) Apply(cfg *tls.Config) *tls.Config {
+	cfg.MinVersion = s.MinVersion
+	cfg.MaxVersion = s.MaxVersion
+	cfg.CipherSuites = s.CipherSuites
+	cfg.CurvePreferences = s.Curves
+	return cfg
+}
+
+// AllowsTLS13 reports whether TLS 1.3, which QUIC requires, is allowed
+func (s *TLSSettings) AllowsTLS13() bool {
+	return s.MaxVersion >= tls.VersionTLS13
+}
+
+// String describes the settings for the startup log
+func (s *TLSSettings) String() string {
+	versions := tls.VersionName(s.MinVersion) + " only"
+	if s.MinVersion != s.MaxVersion {
+		versions = tls.VersionName(s.MinVersion) + " to " + tls.VersionName(s.MaxVersion)
+	}
+	curves := "default key exchanges"
+	if len(s.Curves) > 0 {
+		names := make([]string, len(s.Curves))
+		for i, c := range s.Curves {
+			names[i] = curveName(c)
+		}
+		curves = "key exchanges " + strings.Join(names, ", ")
+	}
+	return versions + ", " + curves
+}
+
+// curveName returns the policy name of a key exchange
+func curveName(id tls.CurveID) string {
+	for name, c := range tlsCurves {
+		if c == id {
+			return name
+		}
+	}
+	return id.String()
+}
+
+// DescribeTLS describes the negotiated version, cipher suite and key exchange
+func DescribeTLS(state tls.ConnectionState) string {
+	desc := tls.VersionName(state.Version) + ", " + tls.CipherSuiteName(state.CipherSuite)
+	if state.CurveID != 0 {
+		desc += ", " + curveName(state.CurveID)
+	}
+	return desc
+}
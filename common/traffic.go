@@ -0,0 +1,184 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// byteUnits maps the units of a byte size, SI and binary, and bits for link speeds
+var byteUnits = map[string]float64{
+	"":     1,
+	"b":    1,
+	"k":    1e3,
+	"kb":   1e3,
+	"kib":  1 << 10,
+	"m":    1e6,
+	"mb":   1e6,
+	"mib":  1 << 20,
+	"g":    1e9,
+	"gb":   1e9,
+	"gib":  1 << 30,
+	"t":    1e12,
+	"tb":   1e12,
+	"tib":  1 << 40,
+	"kbit": 1e3 / 8,
+	"mbit": 1e6 / 8,
+	"gbit": 1e9 / 8,
+}
+
+// ParseByteSize parses a number of bytes such as "1500", "2.5MB", "512KiB",
+// "500GB" or "20Mbit", an empty string is 0
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size '%s', expected a number with an optional unit such as KB, MiB, GB or Mbit", s)
+	}
+	bytes := n * unit
+	if bytes > 1<<62 {
+		return 0, fmt.Errorf("size '%s' is out of range", s)
+	}
+	return int64(bytes), nil
+}
+
+// FormatBytes formats a number of bytes with an SI unit, like "1.5 GB"
+func FormatBytes(n int64) string {
+	const units = "kMGTPE"
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, i := float64(n)/1000, 0
+	for v >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", v, units[i])
+}
+
+// ByteLimiter is a token bucket for bytes that holds back up to one second
+// of traffic, a rate of 0 is unlimited
+// Callers reserve their bytes and sleep off the debt, so connections sharing
+// a limiter are served in turn
+type ByteLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewByteLimiter creates a byte limiter for rate bytes per second
+func NewByteLimiter(rate int64) *ByteLimiter {
+	l := &ByteLimiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate, connections using the limiter follow right away
+func (l *ByteLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	l.tokens = min(l.tokens, l.rate)
+	l.last = time.Now()
+}
+
+// Rate returns the rate in bytes per second, 0 if unlimited
+func (l *ByteLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// Wait blocks until n bytes may pass
+func (l *ByteLimiter) Wait(n int) {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// ErrQuotaExceeded is returned by a ShapedConn once its traffic quota is used up
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// ShapedConn throttles and counts the bytes read from and written to a connection
+type ShapedConn struct {
+	net.Conn
+	readLimits  []*ByteLimiter
+	writeLimits []*ByteLimiter
+	quota       func() bool
+	counters    []*atomic.Int64
+}
+
+// NewShapedConn wraps a connection so reads pass readLimits and writes pass
+// writeLimits, the bytes of both directions are added to every counter
+// quota, if not nil, is checked before every read and write, which fail with
+// ErrQuotaExceeded once it returns false
+func NewShapedConn(conn net.Conn, readLimits, writeLimits []*ByteLimiter, quota func() bool, counters ...*atomic.Int64) *ShapedConn {
+	return &ShapedConn{Conn: conn, readLimits: readLimits, writeLimits: writeLimits, quota: quota, counters: counters}
+}
+
+// Read reads from the connection and waits until the bytes read may pass
+func (c *ShapedConn) Read(p []byte) (int, error) {
+	if c.quota != nil && !c.quota() {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.count(n)
+		for _, l := range c.readLimits {
+			l.Wait(n)
+		}
+	}
+	return n, err
+}
+
+// Write waits until the bytes may pass and writes them to the connection
+func (c *ShapedConn) Write(p []byte) (int, error) {
+	if c.quota != nil && !c.quota() {
+		return 0, ErrQuotaExceeded
+	}
+	for _, l := range c.writeLimits {
+		l.Wait(len(p))
+	}
+	n, err := c.Conn.Write(p)
+	c.count(n)
+	return n, err
+}
+
+// CloseWrite ends the write direction of the wrapped connection
+func (c *ShapedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// count adds transferred bytes to the counters
+func (c *ShapedConn) count(n int) {
+	for _, counter := range c.counters {
+		counter.Add(int64(n))
+	}
+}
@@ -8,8 +8,14 @@ type Mapping struct {
 }
 
 // Handshake represents the client handshake data
+// ClientID groups parallel sessions opened by the same client process
+// ResumeWindow is the number of seconds streams may wait for a reconnect
+// Token authenticates the client when the server uses token authentication
 type Handshake struct {
-	Mappings []Mapping `json:"mappings"`
+	Mappings     []Mapping `json:"mappings"`
+	ClientID     string    `json:"client_id,omitempty"`
+	ResumeWindow int       `json:"resume_window,omitempty"`
+	Token        string    `json:"token,omitempty"`
 }
 
 // ValidatePort validates that a port is in the valid range
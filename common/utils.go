@@ -80,10 +80,26 @@ func (rl *RateLimiter) Allow() bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
-	elapsed := now.Sub(rl.lastRefill)
+	rl.refill()
+	if rl.tokens > 0 {
+		rl.tokens--
+		return true
+	}
+	return false
+}
+
+// Tokens returns the tokens available without consuming any
+func (rl *RateLimiter) Tokens() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	// Refill tokens based on elapsed time
+	rl.refill()
+	return rl.tokens
+}
+
+// refill adds the tokens earned since the last refill, the caller holds rl.mu
+func (rl *RateLimiter) refill() {
+	elapsed := time.Since(rl.lastRefill)
 	if elapsed > 0 {
 		tokensToAdd := int(elapsed / rl.refillRate)
 		if tokensToAdd > 0 {
@@ -91,12 +107,6 @@ func (rl *RateLimiter) Allow() bool {
 			rl.lastRefill = rl.lastRefill.Add(time.Duration(tokensToAdd) * rl.refillRate)
 		}
 	}
-
-	if rl.tokens > 0 {
-		rl.tokens--
-		return true
-	}
-	return false
 }
 
 // SetKeepAlive sets TCP keepalive on a TLS connection
@@ -2,4 +2,15 @@ module z44-tunnel
 
 go 1.25.5
 
-require github.com/hashicorp/yamux v0.1.2
+require (
+	github.com/hashicorp/yamux v0.1.2
+	github.com/miekg/pkcs11 v1.1.2
+	github.com/quic-go/quic-go v0.61.0
+	golang.org/x/net v0.58.0
+)
+
+require (
+	golang.org/x/crypto v0.55.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+)
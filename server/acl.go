@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// DefaultBind is the address forwarded ports listen on unless a port policy
+// exposes them, so only a local reverse proxy reaches them
+const DefaultBind = "127.0.0.1"
+
+// PortPolicy controls who may reach a forwarded port and how much traffic it may carry
+type PortPolicy struct {
+	Bind  string   `json:"bind,omitempty"`  // Listen address, default 127.0.0.1
+	Allow []string `json:"allow,omitempty"` // IPs or CIDRs allowed, empty allows any address not denied
+	Deny  []string `json:"deny,omitempty"`  // IPs or CIDRs denied, checked before allow
+
+	Bandwidth    *BandwidthLimit `json:"bandwidth,omitempty"`     // Throughput of all connections to the port together
+	MonthlyQuota string          `json:"monthly_quota,omitempty"` // Bytes per month such as "500GB", then new connections are refused
+
+	MaxConnections      int `json:"max_connections,omitempty"`        // Open connections to the port, 0 for no limit
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"` // Open connections to the port from one source address
+
+	IdleTimeout int `json:"idle_timeout,omitempty"` // Seconds without data in either direction before a connection is closed
+	MaxLifetime int `json:"max_lifetime,omitempty"` // Seconds after which a connection is closed regardless of activity
+}
+
+// portACL is a parsed port policy
+type portACL struct {
+	bind  string
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// allows checks a source address against the deny and allow lists
+func (a *portACL) allows(addr netip.Addr) bool {
+	for _, p := range a.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses IPs and CIDRs, a single IP is a /32 or /128
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s'", e)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP '%s'", e)
+		}
+		// Prefixes never contain zoned addresses, the zone is dropped
+		addr = addr.Unmap().WithZone("")
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// parsePortPolicy checks a port policy and parses its lists
+func parsePortPolicy(p PortPolicy) (*portACL, error) {
+	acl := &portACL{bind: DefaultBind}
+	if p.Bind != "" {
+		if net.ParseIP(p.Bind) == nil {
+			return nil, fmt.Errorf("invalid bind address '%s'", p.Bind)
+		}
+		acl.bind = p.Bind
+	}
+	var err error
+	if acl.allow, err = parsePrefixes(p.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if acl.deny, err = parsePrefixes(p.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return acl, nil
+}
+
+// AccessControl holds the policies of the forwarded ports
+// The lists are replaced on reload, a port without a policy accepts anyone
+type AccessControl struct {
+	mu    sync.RWMutex
+	ports map[int]*portACL
+}
+
+// NewAccessControl creates the access control from the configured port policies
+func NewAccessControl(ports map[int]PortPolicy) (*AccessControl, error) {
+	a := &AccessControl{}
+	if err := a.SetPorts(ports); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetPorts replaces the port policies
+// Open connections are kept, bind addresses apply to listeners opened later
+func (a *AccessControl) SetPorts(ports map[int]PortPolicy) error {
+	acls := make(map[int]*portACL, len(ports))
+	for port, p := range ports {
+		acl, err := parsePortPolicy(p)
+		if err != nil {
+			return fmt.Errorf("port %d: %w", port, err)
+		}
+		acls[port] = acl
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ports = acls
+	return nil
+}
+
+// Bind returns the address a port listens on
+func (a *AccessControl) Bind(port int) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if acl, ok := a.ports[port]; ok {
+		return acl.bind
+	}
+	return DefaultBind
+}
+
+// Allows checks if a connection from remote may reach a port
+func (a *AccessControl) Allows(port int, remote net.Addr) bool {
+	a.mu.RLock()
+	acl, ok := a.ports[port]
+	a.mu.RUnlock()
+	if !ok {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return false
+	}
+	// Prefix.Contains is false for zoned addresses such as fe80::1%eth0,
+	// which would slip past deny lists
+	return acl.allows(addrPort.Addr().Unmap().WithZone(""))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"z44-tunnel/common"
+)
+
+// Config represents the server configuration
+// Every field is optional, a missing config file keeps the defaults
+type Config struct {
+	TunnelAddr    string `json:"tunnel_addr,omitempty"`
+	WebSocketAddr string `json:"websocket_addr,omitempty"`
+	WebSocketPath string `json:"websocket_path,omitempty"`
+	QUICAddr      string `json:"quic_addr,omitempty"`
+	AdminAddr     string `json:"admin_addr,omitempty"`
+	EnrollAddr    string `json:"enroll_addr,omitempty"`
+
+	// AutoRenew lets connected clients renew their certificate over the tunnel
+	AutoRenew bool `json:"auto_renew,omitempty"`
+
+	// Auth is how clients authenticate: "mtls" (default) with a certificate or
+	// "token" with a secret, whose SHA-256 hashes (hex) Tokens lists by client name
+	Auth   string            `json:"auth,omitempty"`
+	Tokens map[string]string `json:"tokens,omitempty"`
+
+	// TrustDomain only admits client certificates whose SPIFFE ID
+	// (spiffe://<trust_domain>/...) is in that trust domain
+	TrustDomain string `json:"trust_domain,omitempty"`
+
+	// TLS sets the allowed versions, cipher suites and key exchanges
+	TLS common.TLSPolicy `json:"tls,omitempty"`
+
+	// Keys: where the server key comes from (default certs/server-key.pem) and
+	// the passphrases of an encrypted server key (or PKCS#11 PIN) and CA key
+	KeySource       string `json:"key_source,omitempty"`
+	KeyPassphrase   string `json:"key_passphrase,omitempty"`
+	CAKeyPassphrase string `json:"ca_key_passphrase,omitempty"`
+
+	// Revocation: a CRL written by "utils revoke" and extra serials (hex)
+	CRLFile        string   `json:"crl_file,omitempty"`
+	RevokedSerials []string `json:"revoked_serials,omitempty"`
+
+	// Clients restricts which client identities may connect and which ports
+	// each may forward, keyed by identity name (URI SAN or common name)
+	Clients map[string]ClientPolicy `json:"clients,omitempty"`
+
+	// Ports sets the listen address and the allowed and denied source
+	// addresses of forwarded ports, keyed by remote port
+	Ports map[int]PortPolicy `json:"ports,omitempty"`
+
+	// RateLimits caps how fast new connections reach the forwarded ports
+	RateLimits RateLimitPolicy `json:"rate_limits,omitempty"`
+
+	// MaxConnectionsPerIP caps the open connections from one source address
+	// over all ports, ports can set their own limits in Ports
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+
+	// UsageFile keeps the monthly byte counts of ports and clients across restarts
+	UsageFile string `json:"usage_file,omitempty"`
+}
+
+// ClientPolicy describes what a client is allowed to do
+type ClientPolicy struct {
+	Ports []int `json:"ports,omitempty"` // Allowed remote ports, empty allows any
+
+	Bandwidth    *BandwidthLimit `json:"bandwidth,omitempty"`     // Throughput of all the client's ports together
+	MonthlyQuota string          `json:"monthly_quota,omitempty"` // Bytes per month such as "500GB", then new connections are refused
+}
+
+// Allows checks if the policy permits forwarding a port
+func (p ClientPolicy) Allows(port int) bool {
+	return len(p.Ports) == 0 || slices.Contains(p.Ports, port)
+}
+
+// LoadConfig loads and validates the configuration, falling back to defaults
+func LoadConfig(path string) (*Config, error) {
+	cfg := Config{
+		TunnelAddr:    TunnelPort,
+		WebSocketPath: DefaultWebSocketPath,
+		Auth:          AuthMTLS,
+		CRLFile:       DefaultCRLFile,
+		UsageFile:     DefaultUsageFile,
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// validateConfig validates the configuration values
+func validateConfig(cfg Config) error {
+	if _, _, err := net.SplitHostPort(cfg.TunnelAddr); err != nil {
+		return fmt.Errorf("invalid tunnel_addr '%s': %w", cfg.TunnelAddr, err)
+	}
+	if cfg.WebSocketAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.WebSocketAddr); err != nil {
+			return fmt.Errorf("invalid websocket_addr '%s': %w", cfg.WebSocketAddr, err)
+		}
+		if !strings.HasPrefix(cfg.WebSocketPath, "/") {
+			return fmt.Errorf("websocket_path must start with '/', got '%s'", cfg.WebSocketPath)
+		}
+	}
+	switch cfg.Auth {
+	case AuthMTLS:
+		if len(cfg.Tokens) > 0 {
+			return fmt.Errorf("tokens are only used with auth '%s'", AuthToken)
+		}
+	case AuthToken:
+		if len(cfg.Tokens) == 0 {
+			return fmt.Errorf("auth '%s' needs at least one entry in tokens", AuthToken)
+		}
+		if cfg.AutoRenew || cfg.EnrollAddr != "" {
+			return fmt.Errorf("auto_renew and enroll_addr issue certificates and need auth '%s'", AuthMTLS)
+		}
+		if _, err := NewTokenAuth(cfg.Tokens); err != nil {
+			return fmt.Errorf("tokens: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown auth '%s', expected '%s' or '%s'", cfg.Auth, AuthMTLS, AuthToken)
+	}
+	settings, err := cfg.TLS.Resolve()
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if cfg.QUICAddr != "" && !settings.AllowsTLS13() {
+		return fmt.Errorf("quic_addr needs TLS 1.3, which tls.max_version excludes")
+	}
+	if cfg.TrustDomain != "" {
+		if cfg.Auth != AuthMTLS {
+			return fmt.Errorf("trust_domain applies to client certificates and needs auth '%s'", AuthMTLS)
+		}
+		if err := common.ValidateTrustDomain(cfg.TrustDomain); err != nil {
+			return fmt.Errorf("invalid trust_domain: %w", err)
+		}
+	}
+	if _, err := common.ParsePassphrase(cfg.KeyPassphrase); err != nil {
+		return fmt.Errorf("key_passphrase: %w", err)
+	}
+	if _, err := common.ParsePassphrase(cfg.CAKeyPassphrase); err != nil {
+		return fmt.Errorf("ca_key_passphrase: %w", err)
+	}
+	if cfg.QUICAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.QUICAddr); err != nil {
+			return fmt.Errorf("invalid quic_addr '%s': %w", cfg.QUICAddr, err)
+		}
+	}
+	if cfg.EnrollAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.EnrollAddr); err != nil {
+			return fmt.Errorf("invalid enroll_addr '%s': %w", cfg.EnrollAddr, err)
+		}
+	}
+	if cfg.UsageFile == "" {
+		return errors.New("usage_file must not be empty")
+	}
+	if cfg.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.AdminAddr); err != nil {
+			return fmt.Errorf("invalid admin_addr '%s': %w", cfg.AdminAddr, err)
+		}
+	}
+	for _, serial := range cfg.RevokedSerials {
+		if _, err := normalizeSerial(serial); err != nil {
+			return fmt.Errorf("invalid revoked_serials: %w", err)
+		}
+	}
+	for port, policy := range cfg.Ports {
+		if !common.ValidatePort(port) {
+			return fmt.Errorf("ports: invalid port %d", port)
+		}
+		if _, err := parseTrafficLimits(policy.Bandwidth, policy.MonthlyQuota); err != nil {
+			return fmt.Errorf("ports: port %d: %w", port, err)
+		}
+		if policy.MaxConnections < 0 || policy.MaxConnectionsPerIP < 0 {
+			return fmt.Errorf("ports: port %d: max_connections and max_connections_per_ip must not be negative", port)
+		}
+		if policy.IdleTimeout < 0 || policy.MaxLifetime < 0 {
+			return fmt.Errorf("ports: port %d: idle_timeout and max_lifetime must not be negative", port)
+		}
+	}
+	if cfg.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("max_connections_per_ip must not be negative, got %d", cfg.MaxConnectionsPerIP)
+	}
+	if _, err := NewAccessControl(cfg.Ports); err != nil {
+		return fmt.Errorf("ports: %w", err)
+	}
+	if _, err := newRateLimitSet(cfg.RateLimits, nil); err != nil {
+		return fmt.Errorf("rate_limits: %w", err)
+	}
+	for name, policy := range cfg.Clients {
+		if common.IsSPIFFEID(name) {
+			_, td, err := common.ParseSPIFFEID(name)
+			if err != nil {
+				return fmt.Errorf("clients: %w", err)
+			}
+			if cfg.TrustDomain != "" && td != cfg.TrustDomain {
+				return fmt.Errorf("client '%s' is not in trust_domain %s", name, cfg.TrustDomain)
+			}
+		}
+		for _, port := range policy.Ports {
+			if !common.ValidatePort(port) {
+				return fmt.Errorf("client '%s': invalid port %d", name, port)
+			}
+		}
+		if _, err := parseTrafficLimits(policy.Bandwidth, policy.MonthlyQuota); err != nil {
+			return fmt.Errorf("client '%s': %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"sync"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// Connection limit scopes, named by their config paths
+const (
+	ScopePortConnections      = "ports.max_connections"
+	ScopePortConnectionsPerIP = "ports.max_connections_per_ip"
+	ScopeConnectionsPerIP     = "max_connections_per_ip"
+)
+
+// connectionLimited counts the connections refused by each connection limit scope
+var connectionLimited = expvar.NewMap("connection_limited")
+
+// connectionsClosed counts the closed connections of forwarded ports by close reason
+var connectionsClosed = expvar.NewMap("connections_closed")
+
+// portConnLimit is the connection limits of a port, 0 for none
+type portConnLimit struct {
+	max      int
+	maxPerIP int
+	pipe     common.PipeLimits
+}
+
+// portSource is a source address connected to a port
+type portSource struct {
+	port   int
+	source string
+}
+
+// ConnectionLimits caps the open connections of each port, of each source
+// address on a port and of each source address over all ports, below the
+// server-wide MaxConcurrentStreams, and how long they may stay open
+// Counts only exist while connections are open, so memory stays bounded
+// Source addresses are keyed like the rate limits, IPv6 by /64
+type ConnectionLimits struct {
+	mu         sync.Mutex
+	limits     map[int]portConnLimit
+	maxPerIP   int
+	ports      map[int]int
+	portIPs    map[portSource]int
+	sources    map[string]int
+	rejections *RejectionLog
+}
+
+// NewConnectionLimits creates the connection limits from the port policies
+// and the server-wide limit per source address
+func NewConnectionLimits(ports map[int]PortPolicy, maxPerIP int, rejections *RejectionLog) *ConnectionLimits {
+	c := &ConnectionLimits{
+		ports:      make(map[int]int),
+		portIPs:    make(map[portSource]int),
+		sources:    make(map[string]int),
+		rejections: rejections,
+	}
+	c.SetLimits(ports, maxPerIP)
+	return c
+}
+
+// SetLimits replaces the limits, open connections are kept even above them
+func (c *ConnectionLimits) SetLimits(ports map[int]PortPolicy, maxPerIP int) {
+	limits := make(map[int]portConnLimit, len(ports))
+	for port, p := range ports {
+		limits[port] = portConnLimit{
+			max:      p.MaxConnections,
+			maxPerIP: p.MaxConnectionsPerIP,
+			pipe: common.PipeLimits{
+				IdleTimeout: time.Duration(p.IdleTimeout) * time.Second,
+				MaxLifetime: time.Duration(p.MaxLifetime) * time.Second,
+			},
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = limits
+	c.maxPerIP = maxPerIP
+}
+
+// Acquire counts a new connection to a port, or refuses it if a limit is reached
+// The returned release function must be called once the connection is closed
+func (c *ConnectionLimits) Acquire(port int, remote net.Addr) (func(), bool) {
+	key := portSource{port: port, source: sourceKey(remote)}
+
+	c.mu.Lock()
+	limit := c.limits[port]
+	scope := ""
+	switch {
+	case limit.max > 0 && c.ports[port] >= limit.max:
+		scope = ScopePortConnections
+	case limit.maxPerIP > 0 && c.portIPs[key] >= limit.maxPerIP:
+		scope = ScopePortConnectionsPerIP
+	case c.maxPerIP > 0 && c.sources[key.source] >= c.maxPerIP:
+		scope = ScopeConnectionsPerIP
+	}
+	if scope == "" {
+		c.ports[port]++
+		c.portIPs[key]++
+		c.sources[key.source]++
+	}
+	c.mu.Unlock()
+
+	if scope != "" {
+		connectionLimited.Add(scope, 1)
+		what := fmt.Sprintf("port %d from %s", port, key.source)
+		if scope == ScopePortConnections {
+			what = fmt.Sprintf("port %d", port)
+		}
+		c.rejections.Add(scope, what)
+		return nil, false
+	}
+	return func() { c.release(key) }, true
+}
+
+// release uncounts a closed connection and drops counts that reach zero
+func (c *ConnectionLimits) release(key portSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ports[key.port]--; c.ports[key.port] <= 0 {
+		delete(c.ports, key.port)
+	}
+	if c.portIPs[key]--; c.portIPs[key] <= 0 {
+		delete(c.portIPs, key)
+	}
+	if c.sources[key.source]--; c.sources[key.source] <= 0 {
+		delete(c.sources, key.source)
+	}
+}
+
+// PipeLimits returns the idle timeout and maximum lifetime of a port's connections
+func (c *ConnectionLimits) PipeLimits(port int) common.PipeLimits {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limits[port].pipe
+}
+
+// Closed records why a connection to a port was closed
+// src is the public side and dst the tunnel, closes by a limit are logged
+func (c *ConnectionLimits) Closed(port int, remote net.Addr, reason common.CloseReason, lifetime time.Duration) {
+	switch reason {
+	case common.CloseSrcDone:
+		connectionsClosed.Add("public_closed", 1)
+	case common.CloseDstDone:
+		connectionsClosed.Add("tunnel_closed", 1)
+	default:
+		connectionsClosed.Add(string(reason), 1)
+		log.Printf("⏱️ Port %d: connection from %s closed after %s (%s)", port, remote, lifetime.Round(time.Second), reason)
+	}
+}
+
+// Snapshot returns the open connections per port for the open_connections metric
+func (c *ConnectionLimits) Snapshot() any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.ports)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"z44-tunnel/common"
+)
+
+// maxEnrollRequestSize bounds the JSON body of an enrollment request
+const maxEnrollRequestSize = 64 << 10
+
+// serveEnrollment accepts certificate requests from new clients holding a
+// one-time token issued with "utils issue-token"
+// Only the server authenticates in TLS, the token authenticates the client
+func serveEnrollment(addr string, certs *common.CertReloader, store *common.CertStore, settings *common.TLSSettings) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+common.EnrollPath, func(w http.ResponseWriter, r *http.Request) {
+		handleEnroll(w, r, store)
+	})
+
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+		TLSConfig: settings.Apply(&tls.Config{
+			GetCertificate: certs.GetCertificate,
+		}),
+		ReadHeaderTimeout: HandshakeTimeout,
+	}
+
+	log.Printf("🎫 Enrollment endpoint ready on %s%s", addr, common.EnrollPath)
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+		log.Printf("Enrollment endpoint stopped: %v", err)
+	}
+}
+
+// handleEnroll exchanges a token and a CSR for a signed client certificate
+func handleEnroll(w http.ResponseWriter, r *http.Request, store *common.CertStore) {
+	var req common.EnrollRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEnrollRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// A malformed request must not use up the one-time token
+	csr, err := common.ParseCSR(req.CSR)
+	if err != nil {
+		log.Printf("❌ Enrollment from %s refused: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := store.ConsumeToken(req.Token)
+	if err != nil {
+		log.Printf("❌ Enrollment from %s refused: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	der, err := store.Enroll(token, csr)
+	if err != nil {
+		log.Printf("❌ Enrollment of client %s from %s failed: %v", token.Name, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chain, err := store.EncodeChain(der)
+	var ca []byte
+	if err == nil {
+		ca, err = os.ReadFile(store.Path("ca.pem"))
+	}
+	if err != nil {
+		log.Printf("Failed to read CA bundle: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🎫 Enrolled client %s from %s", token.Name, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(common.EnrollResponse{
+		Certificate: string(chain),
+		CA:          string(ca),
+	})
+}
@@ -28,20 +28,45 @@ func forwardLoop(ln net.Listener, port int, server *TunnelServer) {
 			continue
 		}
 
-		sess := server.GetActiveSession()
+		if !server.access.Allows(port, conn.RemoteAddr()) {
+			log.Printf("🚫 Port %d: connection from %s denied by its access list", port, conn.RemoteAddr())
+			common.CloseConn(conn)
+			continue
+		}
+
+		pool := server.GetPortPool(port)
+		if pool == nil {
+			common.CloseConn(conn)
+			continue
+		}
+		sess := pool.Pick()
 		if sess == nil || sess.IsClosed() {
 			common.CloseConn(conn)
 			continue
 		}
 
-		// Rate limiting: check token bucket and stream count
-		if !server.rateLimiter.Allow() {
-			log.Printf("Rate limit exceeded for port %d", port)
+		// Rate limiting: refusals are summed up in the log by the rejection log
+		owner := pool.Identity().Name()
+		if !server.limits.Allow(port, owner, conn.RemoteAddr()) {
+			common.CloseConn(conn)
+			continue
+		}
+
+		// Monthly quotas: the first refusal is logged by TrafficControl
+		if !server.traffic.Allow(port, owner) {
+			common.CloseConn(conn)
+			continue
+		}
+
+		// Connection limits: refusals are summed up like the rate limits
+		release, ok := server.conns.Acquire(port, conn.RemoteAddr())
+		if !ok {
 			common.CloseConn(conn)
 			continue
 		}
 
 		if !server.IncrementStreamCount() {
+			release()
 			log.Printf("Max concurrent streams reached for port %d", port)
 			common.CloseConn(conn)
 			continue
@@ -49,13 +74,23 @@ func forwardLoop(ln net.Listener, port int, server *TunnelServer) {
 
 		stream, err := sess.Open()
 		if err != nil {
+			release()
 			server.DecrementStreamCount()
 			log.Printf("Failed to open stream port %d: %v", port, err)
 			common.CloseConn(conn)
 			continue
 		}
 
-		if _, err := fmt.Fprintf(stream, "%d\n", port); err != nil {
+		// Resumable streams carry a stream ID after the port
+		var streamID uint64
+		header := fmt.Sprintf("%d\n", port)
+		if pool.ResumeWindow() > 0 {
+			streamID = server.nextStreamID.Add(1)
+			header = fmt.Sprintf("%d %d\n", port, streamID)
+		}
+
+		if _, err := io.WriteString(stream, header); err != nil {
+			release()
 			server.DecrementStreamCount()
 			common.CloseConn(conn)
 			common.CloseConn(stream)
@@ -68,6 +103,7 @@ func forwardLoop(ln net.Listener, port int, server *TunnelServer) {
 		stream.SetReadDeadline(time.Time{})
 
 		if err != nil || n < 2 || string(buf[:2]) != "OK" {
+			release()
 			server.DecrementStreamCount()
 			log.Printf("❌ Zombie detected port %d", port)
 			sess.Close()
@@ -76,6 +112,11 @@ func forwardLoop(ln net.Listener, port int, server *TunnelServer) {
 			continue
 		}
 
+		var tunnelConn net.Conn = stream
+		if streamID != 0 {
+			tunnelConn = server.newResumableStream(streamID, stream, pool)
+		}
+
 		go func(c, s net.Conn) {
 			defer func() {
 				if r := recover(); r != nil {
@@ -83,9 +124,15 @@ func forwardLoop(ln net.Listener, port int, server *TunnelServer) {
 				}
 			}()
 			defer server.DecrementStreamCount()
+			defer release()
 			defer common.CloseConn(c)
 			defer common.CloseConn(s)
-			common.PipeConnections(c, s, "conn/stream")
-		}(conn, stream)
+			if streamID != 0 {
+				defer server.resumable.Remove(streamID)
+			}
+			start := time.Now()
+			reason := common.PipeWithLimits(server.traffic.Shape(c, port, owner), s, "conn/stream", server.conns.PipeLimits(port))
+			server.conns.Closed(port, c.RemoteAddr(), reason, time.Since(start))
+		}(conn, tunnelConn)
 	}
 }
@@ -1,65 +1,146 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"time"
 
 	"z44-tunnel/common"
 
 	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
 )
 
-// handleClient handles a new client connection
-func handleClient(conn net.Conn, server *TunnelServer) {
+// handleTLSClient completes the TLS handshake to learn the client identity
+func handleTLSClient(conn *tls.Conn, server *TunnelServer) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("TLS handshake failed from %s: %v", conn.RemoteAddr(), err)
+		common.CloseConn(conn)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	id, err := server.identify(state)
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		common.CloseConn(conn)
+		return
+	}
+	handleClient(conn, state, id, server)
+}
+
+// handleClient handles a new raw TLS or WebSocket client connection
+func handleClient(conn net.Conn, state tls.ConnectionState, id *ClientIdentity, server *TunnelServer) {
 	defer common.CloseConn(conn)
 
 	if conn.RemoteAddr() == nil {
 		return
 	}
-	log.Println("New connection:", conn.RemoteAddr())
+	log.Printf("New connection: %s from %s (%s)", conn.RemoteAddr(), id, common.DescribeTLS(state))
 
 	session, err := yamux.Server(conn, common.YamuxConfig(PingInterval, WriteTimeout))
 	if err != nil {
 		log.Printf("Failed to create yamux session: %v", err)
 		return
 	}
+	serveSession(session, id, server)
+}
+
+// handleQUICClient handles a new QUIC client connection
+func handleQUICClient(conn *quic.Conn, server *TunnelServer) {
+	state := conn.ConnectionState().TLS
+	id, err := server.identify(state)
+	if err != nil {
+		log.Printf("Rejected QUIC connection from %s: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(0, "")
+		return
+	}
+	log.Printf("New QUIC connection: %s from %s (%s)", conn.RemoteAddr(), id, common.DescribeTLS(state))
+	serveSession(common.NewQUICSession(conn), id, server)
+}
+
+// serveSession reads the client handshake and forwards its ports
+// until the session closes
+// A nil id is a token client, authenticated by the token in its handshake
+func serveSession(session common.Session, id *ClientIdentity, server *TunnelServer) {
 	defer common.CloseSession(session)
 
-	stream, err := session.Accept()
+	h, err := readHandshake(session)
 	if err != nil {
-		log.Printf("Failed to accept handshake: %v", err)
+		log.Printf("Failed to read handshake from %s: %v", id, err)
 		return
 	}
+	if id == nil {
+		if id, err = server.tokens.Authenticate(h.Token); err != nil {
+			log.Printf("❌ Token authentication failed: %v", err)
+			return
+		}
+		log.Printf("🔑 Client %s authenticated", id)
+	}
 
-	var h Handshake
-	if err := json.NewDecoder(stream).Decode(&h); err != nil {
-		log.Printf("Failed to decode handshake: %v", err)
-		common.CloseConn(stream)
+	policy, ok := server.Authorize(id)
+	if !ok {
+		log.Printf("❌ Client %s is not authorized", id)
 		return
 	}
-	common.CloseConn(stream)
 
 	if len(h.Mappings) == 0 {
 		return
 	}
 
-	server.SetActiveSession(session)
+	var resumeWindow time.Duration
+	if h.ClientID != "" && h.ResumeWindow > 0 {
+		resumeWindow = min(time.Duration(h.ResumeWindow)*time.Second, MaxResumeWindow)
+	}
+	name := id.Name()
+	if server.revoked(id) {
+		log.Printf("🚫 Client %s is revoked", id)
+		return
+	}
+	if id.Certificate != nil {
+		common.RecordExpiry("client/"+name, id.Certificate)
+	}
+	server.AddSession(id, h.ClientID, resumeWindow, session)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic in serveControl: %v", r)
+			}
+		}()
+		server.serveControl(session, id)
+	}()
 
 	for _, m := range h.Mappings {
-		if !common.ValidatePort(m.RemotePort) || server.HasListener(m.RemotePort) {
+		if !common.ValidatePort(m.RemotePort) {
+			continue
+		}
+		if !policy.Allows(m.RemotePort) {
+			log.Printf("❌ Client %s may not forward port %d", name, m.RemotePort)
+			continue
+		}
+		if owner, ok := server.ClaimPort(m.RemotePort, name); !ok {
+			log.Printf("❌ Port %d is already forwarded by client %s", m.RemotePort, owner)
+			continue
+		}
+		if server.HasListener(m.RemotePort) {
 			continue
 		}
 
-		addr := fmt.Sprintf("127.0.0.1:%d", m.RemotePort)
+		addr := net.JoinHostPort(server.access.Bind(m.RemotePort), strconv.Itoa(m.RemotePort))
 		l, err := net.Listen("tcp", addr)
 		if err != nil {
 			log.Printf("Failed to listen on %s: %v", addr, err)
 			continue
 		}
 		server.AddListener(m.RemotePort, l)
-		log.Printf("✅ Forwarding port %d", m.RemotePort)
+		log.Printf("✅ Forwarding port %d for client %s", m.RemotePort, name)
 		go func(listener net.Listener, p int) {
 			defer func() {
 				if r := recover(); r != nil {
@@ -70,7 +151,59 @@ func handleClient(conn net.Conn, server *TunnelServer) {
 		}(l, m.RemotePort)
 	}
 
-	<-session.CloseChan()
-	log.Println("⚠️ Client disconnected")
-	server.ClearActiveSession(session)
+	if server.waitSession(session, id) {
+		log.Printf("⚠️ Client %s disconnected", name)
+	}
+	server.RemoveSession(name, session)
+}
+
+// readHandshake reads the handshake on the first stream of a session
+// A client that does not send it in time is dropped
+func readHandshake(session common.Session) (*Handshake, error) {
+	timer := time.AfterFunc(HandshakeTimeout, func() { common.CloseSession(session) })
+	defer timer.Stop()
+
+	stream, err := session.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept handshake: %w", err)
+	}
+	defer common.CloseConn(stream)
+
+	var h Handshake
+	if err := json.NewDecoder(io.LimitReader(stream, MaxHandshakeSize)).Decode(&h); err != nil {
+		return nil, fmt.Errorf("failed to decode handshake: %w", err)
+	}
+	return &h, nil
+}
+
+// revoked checks if the certificate of a client, or any certificate of its
+// chain, is revoked, or if the token it authenticated with was removed
+func (s *TunnelServer) revoked(id *ClientIdentity) bool {
+	if id.token != nil {
+		return !s.tokens.Accepts(id)
+	}
+	return s.revocation.IsRevoked(id.Serial) || s.revocation.AnyRevoked(id.Chain)
+}
+
+// waitSession blocks until the session closes or its certificate or token
+// is revoked
+// It returns false if the session was cut because of a revocation
+func (s *TunnelServer) waitSession(session common.Session, id *ClientIdentity) bool {
+	for {
+		changed := s.revocation.Changed()
+		var tokensChanged <-chan struct{}
+		if s.tokens != nil {
+			tokensChanged = s.tokens.Changed()
+		}
+		if s.revoked(id) {
+			log.Printf("🚫 Credentials of client %s were revoked, disconnecting", id)
+			return false
+		}
+		select {
+		case <-session.CloseChan():
+			return true
+		case <-changed:
+		case <-tokensChanged:
+		}
+	}
 }
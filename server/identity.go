@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+
+	"z44-tunnel/common"
+)
+
+// ClientIdentity is the identity carried by a verified client certificate,
+// or by a token without a certificate or serial
+type ClientIdentity struct {
+	CommonName  string
+	URIs        []string
+	Serial      string
+	Chain       []string // Serials of the verified chain, the leaf's included
+	Certificate *x509.Certificate
+	token       []byte // SHA-256 of the token it authenticated with, nil for certificates
+}
+
+// Name returns the name the client is known by, its first URI SAN if it
+// has one and its common name otherwise
+func (id *ClientIdentity) Name() string {
+	if len(id.URIs) > 0 {
+		return id.URIs[0]
+	}
+	return id.CommonName
+}
+
+// String returns the identity for logging
+// A nil identity is a token client that has not sent its handshake yet
+func (id *ClientIdentity) String() string {
+	switch {
+	case id == nil:
+		return "unauthenticated client"
+	case id.Certificate == nil:
+		return fmt.Sprintf("%s (token)", id.Name())
+	default:
+		return fmt.Sprintf("%s (serial %s)", id.Name(), id.Serial)
+	}
+}
+
+// identify returns the identity of a client after its TLS handshake
+// With token authentication it returns nil, the identity comes with the handshake
+func (s *TunnelServer) identify(state tls.ConnectionState) (*ClientIdentity, error) {
+	if s.tokens != nil {
+		return nil, nil
+	}
+	id, err := identityFromState(state, s.trustDomain)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake verified the chain already, this keeps its serials
+	// so the session is cut if an intermediate is revoked later
+	if id.Chain, err = s.revocation.VerifyClient(state.PeerCertificates); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// identityFromState extracts the client identity from a completed TLS handshake
+// A non-empty trustDomain requires a SPIFFE ID in that trust domain
+func identityFromState(state tls.ConnectionState, trustDomain string) (*ClientIdentity, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+	cert := state.PeerCertificates[0]
+
+	id := &ClientIdentity{
+		CommonName:  cert.Subject.CommonName,
+		Serial:      cert.SerialNumber.Text(16),
+		Certificate: cert,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	if id.Name() == "" {
+		return nil, errors.New("client certificate has neither a common name nor a URI SAN")
+	}
+	if err := checkSPIFFEID(id.URIs, trustDomain); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// checkSPIFFEID validates the SPIFFE ID of a certificate, which like an
+// X.509-SVID must be its only URI SAN
+// A non-empty trustDomain requires one in that trust domain
+func checkSPIFFEID(uris []string, trustDomain string) error {
+	if !slices.ContainsFunc(uris, common.IsSPIFFEID) {
+		if trustDomain != "" {
+			return fmt.Errorf("client certificate has no SPIFFE ID in trust domain %s", trustDomain)
+		}
+		return nil
+	}
+	if len(uris) > 1 {
+		return errors.New("client certificate has a SPIFFE ID and other URI SANs")
+	}
+	_, td, err := common.ParseSPIFFEID(uris[0])
+	if err != nil {
+		return err
+	}
+	if trustDomain != "" && td != trustDomain {
+		return fmt.Errorf("SPIFFE ID %s is not in trust domain %s", uris[0], trustDomain)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// SessionPool groups the parallel sessions of one logical client
+type SessionPool struct {
+	mu           sync.Mutex
+	identity     *ClientIdentity
+	clientID     string
+	resumeWindow time.Duration
+	sessions     []common.Session
+	next         int
+}
+
+// NewSessionPool creates an empty session pool for a client
+// resumeWindow is zero when the client does not resume streams
+func NewSessionPool(identity *ClientIdentity, clientID string, resumeWindow time.Duration) *SessionPool {
+	return &SessionPool{identity: identity, clientID: clientID, resumeWindow: resumeWindow}
+}
+
+// Identity returns the certificate identity of the client
+func (p *SessionPool) Identity() *ClientIdentity {
+	return p.identity
+}
+
+// ClientID returns the client ID the pool belongs to
+func (p *SessionPool) ClientID() string {
+	return p.clientID
+}
+
+// ResumeWindow returns how long the client's streams survive a reconnect
+func (p *SessionPool) ResumeWindow() time.Duration {
+	return p.resumeWindow
+}
+
+// Add adds a session to the pool
+func (p *SessionPool) Add(session common.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions = append(p.sessions, session)
+}
+
+// Remove removes a session from the pool and returns the remaining count
+func (p *SessionPool) Remove(session common.Session) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.sessions {
+		if s == session {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			break
+		}
+	}
+	return len(p.sessions)
+}
+
+// Contains checks if a session belongs to the pool
+func (p *SessionPool) Contains(session common.Session) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		if s == session {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of sessions in the pool
+func (p *SessionPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// Pick returns the open session with the fewest active streams
+// Ties are broken round-robin so idle sessions share new streams evenly
+func (p *SessionPool) Pick() common.Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.sessions)
+	if n == 0 {
+		return nil
+	}
+
+	var best common.Session
+	bestIdx, bestStreams := 0, 0
+	for i := 0; i < n; i++ {
+		idx := (p.next + i) % n
+		s := p.sessions[idx]
+		if s.IsClosed() {
+			continue
+		}
+		if streams := s.NumStreams(); best == nil || streams < bestStreams {
+			best, bestIdx, bestStreams = s, idx, streams
+		}
+	}
+	if best != nil {
+		p.next = (bestIdx + 1) % n
+	}
+	return best
+}
+
+// Close closes every session in the pool
+func (p *SessionPool) Close() {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = nil
+	p.mu.Unlock()
+
+	for _, s := range sessions {
+		common.CloseSession(s)
+	}
+}
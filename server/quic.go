@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+
+	"z44-tunnel/common"
+
+	"github.com/quic-go/quic-go"
+)
+
+// serveQUIC accepts QUIC tunnel connections
+// The TLS config is shared with the raw listener so client certificates
+// are verified the same way, QUIC only adds its ALPN protocol and TLS 1.3
+func serveQUIC(addr string, tlsConfig *tls.Config, server *TunnelServer) {
+	quicTLS := tlsConfig.Clone()
+	quicTLS.NextProtos = []string{common.QUICProtocol}
+	quicTLS.MinVersion = tls.VersionTLS13
+
+	ln, err := quic.ListenAddr(addr, quicTLS, common.QUICConfig(PingInterval, WriteTimeout))
+	if err != nil {
+		log.Printf("Failed to start QUIC listener on %s: %v", addr, err)
+		return
+	}
+	defer ln.Close()
+
+	log.Printf("⚡ QUIC endpoint ready on %s", addr)
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			log.Printf("QUIC listener stopped: %v", err)
+			return
+		}
+
+		go func(c *quic.Conn) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in handleClient: %v", r)
+				}
+			}()
+			handleQUICClient(c, server)
+		}(conn)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// Rate limit settings
+const (
+	DefaultMaxSourceIPs = 10000   // Source addresses tracked at once unless configured
+	MaxLimitedKeys      = 1 << 16 // Upper bound on the port and client buckets
+)
+
+// Rate limit scopes, named like their config fields
+const (
+	ScopeGlobal      = "global"
+	ScopePerPort     = "per_port"
+	ScopePerClient   = "per_client"
+	ScopePerSourceIP = "per_source_ip"
+)
+
+// rateLimited counts the connections refused by each rate limit scope
+var rateLimited = expvar.NewMap("rate_limited")
+
+// RateLimit is a token bucket for new connections to forwarded ports
+type RateLimit struct {
+	Rate  float64 `json:"rate"`            // Connections per second
+	Burst int     `json:"burst,omitempty"` // Connections allowed at once, default the rate rounded up
+}
+
+// bucket returns the size and refill interval of the token bucket
+func (l RateLimit) bucket() (int, time.Duration, error) {
+	if l.Rate <= 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return 0, 0, fmt.Errorf("rate must be above 0, got %v", l.Rate)
+	}
+	refill := time.Duration(float64(time.Second) / l.Rate)
+	if refill <= 0 {
+		return 0, 0, fmt.Errorf("rate %v is too high", l.Rate)
+	}
+	if l.Burst < 0 {
+		return 0, 0, fmt.Errorf("burst must not be negative, got %d", l.Burst)
+	}
+	burst := l.Burst
+	if burst == 0 {
+		burst = max(1, int(math.Ceil(l.Rate)))
+	}
+	return burst, refill, nil
+}
+
+// RateLimitPolicy is the "rate_limits" section of the server config
+// Limits left out are off, except the global one which defaults to
+// 100 connections per second
+type RateLimitPolicy struct {
+	Global       *RateLimit `json:"global,omitempty"`         // All ports together
+	PerPort      *RateLimit `json:"per_port,omitempty"`       // Each forwarded port
+	PerClient    *RateLimit `json:"per_client,omitempty"`     // All ports of a client together
+	PerSourceIP  *RateLimit `json:"per_source_ip,omitempty"`  // Each source address, IPv6 by /64
+	MaxSourceIPs int        `json:"max_source_ips,omitempty"` // Source addresses tracked at once, default 10000
+}
+
+// sameLimit checks if two optional rate limits are the same
+func sameLimit(a, b *RateLimit) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// rateLimitSet holds the buckets of a policy, nil for limits that are off
+type rateLimitSet struct {
+	policy      RateLimitPolicy
+	global      *common.RateLimiter
+	perPort     *common.KeyedRateLimiter
+	perClient   *common.KeyedRateLimiter
+	perSourceIP *common.KeyedRateLimiter
+}
+
+// newRateLimitSet checks a policy and creates its buckets
+// Buckets of prev whose settings did not change are kept with their tokens,
+// prev may be nil
+func newRateLimitSet(p RateLimitPolicy, prev *rateLimitSet) (*rateLimitSet, error) {
+	if prev == nil {
+		prev = &rateLimitSet{}
+	}
+	set := &rateLimitSet{policy: p}
+	switch {
+	case prev.global != nil && sameLimit(p.Global, prev.policy.Global):
+		set.global = prev.global
+	case p.Global == nil:
+		set.global = common.NewRateLimiter(StreamRateLimit, StreamRefillRate)
+	default:
+		burst, refill, err := p.Global.bucket()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ScopeGlobal, err)
+		}
+		set.global = common.NewRateLimiter(burst, refill)
+	}
+
+	if p.MaxSourceIPs < 0 {
+		return nil, errors.New("max_source_ips must not be negative")
+	}
+	maxSourceIPs := cmp.Or(p.MaxSourceIPs, DefaultMaxSourceIPs)
+
+	keyed := []struct {
+		scope   string
+		limit   *RateLimit
+		maxKeys int
+		dst     **common.KeyedRateLimiter
+		prev    *common.KeyedRateLimiter
+		same    bool
+	}{
+		{ScopePerPort, p.PerPort, MaxLimitedKeys, &set.perPort, prev.perPort,
+			sameLimit(p.PerPort, prev.policy.PerPort)},
+		{ScopePerClient, p.PerClient, MaxLimitedKeys, &set.perClient, prev.perClient,
+			sameLimit(p.PerClient, prev.policy.PerClient)},
+		{ScopePerSourceIP, p.PerSourceIP, maxSourceIPs, &set.perSourceIP, prev.perSourceIP,
+			sameLimit(p.PerSourceIP, prev.policy.PerSourceIP) && maxSourceIPs == cmp.Or(prev.policy.MaxSourceIPs, DefaultMaxSourceIPs)},
+	}
+	for _, k := range keyed {
+		if k.limit == nil {
+			continue
+		}
+		if k.prev != nil && k.same {
+			*k.dst = k.prev
+			continue
+		}
+		burst, refill, err := k.limit.bucket()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.scope, err)
+		}
+		*k.dst = common.NewKeyedRateLimiter(burst, refill, k.maxKeys)
+	}
+	return set, nil
+}
+
+// sourceKey returns the bucket key of a source address
+// IPv6 clients usually hold a whole /64, so it shares one bucket
+func sourceKey(remote net.Addr) string {
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return remote.String()
+	}
+	// Zoned addresses have no prefix, so the zone is dropped
+	addr := addrPort.Addr().Unmap().WithZone("")
+	if addr.Is6() {
+		return netip.PrefixFrom(addr, 64).Masked().String()
+	}
+	return addr.String()
+}
+
+// RateLimiters limits how fast new connections reach the forwarded ports,
+// per source address, per port, per client and overall
+// Refused connections are counted in the rate_limited metric and summed up
+// by the rejection log
+type RateLimiters struct {
+	mu         sync.RWMutex
+	allowMu    sync.Mutex // Makes checking and taking tokens over all scopes atomic
+	set        *rateLimitSet
+	rejections *RejectionLog
+}
+
+// NewRateLimiters creates the rate limiters from the configured policy
+func NewRateLimiters(policy RateLimitPolicy, rejections *RejectionLog) (*RateLimiters, error) {
+	r := &RateLimiters{rejections: rejections}
+	if err := r.SetPolicy(policy); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetPolicy replaces the rate limits
+// Scopes whose settings changed start over with full buckets, the others
+// keep their tokens, so reloading does not lift the limits
+func (r *RateLimiters) SetPolicy(policy RateLimitPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set, err := newRateLimitSet(policy, r.set)
+	if err != nil {
+		return err
+	}
+	r.set = set
+	return nil
+}
+
+// scopeBucket is the bucket a connection takes a token from in one scope
+type scopeBucket struct {
+	scope   string
+	what    string
+	limiter *common.RateLimiter
+}
+
+// Allow checks a new connection to a port owned by client against every
+// rate limit, from the narrowest to the widest scope
+// A token is only taken once every scope has one, so a refused connection
+// does not use up the tokens of the sources and ports it shares a scope with
+func (r *RateLimiters) Allow(port int, client string, remote net.Addr) bool {
+	r.mu.RLock()
+	set := r.set
+	r.mu.RUnlock()
+
+	var buckets []scopeBucket
+	if set.perSourceIP != nil {
+		source := sourceKey(remote)
+		buckets = append(buckets, scopeBucket{ScopePerSourceIP, fmt.Sprintf("port %d from %s", port, source), set.perSourceIP.Limiter(source)})
+	}
+	if set.perPort != nil {
+		buckets = append(buckets, scopeBucket{ScopePerPort, fmt.Sprintf("port %d", port), set.perPort.Limiter(fmt.Sprint(port))})
+	}
+	if set.perClient != nil {
+		buckets = append(buckets, scopeBucket{ScopePerClient, fmt.Sprintf("port %d of %s", port, client), set.perClient.Limiter(client)})
+	}
+	buckets = append(buckets, scopeBucket{ScopeGlobal, fmt.Sprintf("port %d", port), set.global})
+
+	r.allowMu.Lock()
+	defer r.allowMu.Unlock()
+	for _, b := range buckets {
+		if b.limiter.Tokens() == 0 {
+			r.reject(b.scope, b.what)
+			return false
+		}
+	}
+	for _, b := range buckets {
+		b.limiter.Allow()
+	}
+	return true
+}
+
+// reject counts a refused connection
+func (r *RateLimiters) reject(scope, what string) {
+	rateLimited.Add(scope, 1)
+	r.rejections.Add(scope, what)
+}
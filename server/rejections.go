@@ -0,0 +1,87 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rejection log settings
+const (
+	RejectionLogInterval = time.Minute // How often refused connections are summed up in the log
+	MaxRejectionEntries  = 100         // Distinct entries kept per summary, the rest count as other
+)
+
+// RejectionLog sums up connections refused by rate and connection limits in
+// the log once per RejectionLogInterval, instead of one line per connection
+type RejectionLog struct {
+	mu         sync.Mutex
+	rejections map[string]int // Refused connections since the last summary, by port, scope and key
+	rejected   int
+}
+
+// NewRejectionLog creates an empty rejection log
+func NewRejectionLog() *RejectionLog {
+	return &RejectionLog{rejections: make(map[string]int)}
+}
+
+// Add counts a refused connection for the next summary
+// what names the port and, if the limit is per key, the key
+func (l *RejectionLog) Add(scope, what string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rejected++
+	entry := what + " (" + scope + ")"
+	if _, ok := l.rejections[entry]; !ok && len(l.rejections) >= MaxRejectionEntries {
+		entry = "other ports and sources"
+	}
+	l.rejections[entry]++
+}
+
+// Run logs the refused connections once per interval
+func (l *RejectionLog) Run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in RejectionLog: %v", r)
+		}
+	}()
+
+	ticker := time.NewTicker(RejectionLogInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if summary := l.summarize(); summary != "" {
+			log.Printf("🚦 %s", summary)
+		}
+	}
+}
+
+// summarize returns and resets the refused connections since the last call,
+// largest first, or "" if there were none
+func (l *RejectionLog) summarize() string {
+	l.mu.Lock()
+	rejections, rejected := l.rejections, l.rejected
+	l.rejections, l.rejected = make(map[string]int), 0
+	l.mu.Unlock()
+
+	if rejected == 0 {
+		return ""
+	}
+	entries := slices.SortedFunc(maps.Keys(rejections), func(a, b string) int {
+		return cmp.Or(cmp.Compare(rejections[b], rejections[a]), strings.Compare(a, b))
+	})
+
+	const shown = 5
+	parts := make([]string, 0, shown+1)
+	for _, entry := range entries[:min(shown, len(entries))] {
+		parts = append(parts, fmt.Sprintf("%d on %s", rejections[entry], entry))
+	}
+	if len(entries) > shown {
+		parts = append(parts, fmt.Sprintf("%d more entries", len(entries)-shown))
+	}
+	return fmt.Sprintf("Refused %d connections in the last %s: %s", rejected, RejectionLogInterval, strings.Join(parts, ", "))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// handleReloads re-reads the certificates, the revoked serials, tokens, port
+// policies, rate, traffic and connection limits from the config and the CRL
+// on SIGHUP, and polls the files so a renewed certificate or "utils revoke"
+// takes effect on its own
+// tokens is nil unless clients authenticate with tokens
+func handleReloads(configPath string, certs *common.CertReloader, revocation *Revocation, tokens *TokenAuth, access *AccessControl, limits *RateLimiters, traffic *TrafficControl, conns *ConnectionLimits) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in handleReloads: %v", r)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(ReloadPollInterval)
+	defer ticker.Stop()
+	expiry := time.NewTicker(common.ExpiryCheckInterval)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Println("🔄 SIGHUP received, reloading certificates and configuration")
+			if err := certs.Reload(); err != nil {
+				log.Printf("Failed to reload certificates: %v", err)
+			}
+			cfg, err := LoadConfig(configPath)
+			if err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+				continue
+			}
+			if err := revocation.SetDenylist(cfg.RevokedSerials); err != nil {
+				log.Printf("Failed to reload revoked serials: %v", err)
+			}
+			if err := revocation.Reload(); err != nil {
+				log.Printf("Failed to reload CRL: %v", err)
+			}
+			if tokens != nil {
+				if err := tokens.SetTokens(cfg.Tokens); err != nil {
+					log.Printf("Failed to reload tokens: %v", err)
+				}
+			}
+			if err := access.SetPorts(cfg.Ports); err != nil {
+				log.Printf("Failed to reload port policies: %v", err)
+			}
+			if err := limits.SetPolicy(cfg.RateLimits); err != nil {
+				log.Printf("Failed to reload rate limits: %v", err)
+			}
+			if err := traffic.SetPolicies(cfg.Ports, cfg.Clients); err != nil {
+				log.Printf("Failed to reload traffic limits: %v", err)
+			}
+			conns.SetLimits(cfg.Ports, cfg.MaxConnectionsPerIP)
+		case <-expiry.C:
+			certs.CheckExpiry()
+		case <-ticker.C:
+			if reloaded, err := certs.ReloadIfChanged(); err != nil {
+				log.Printf("Failed to reload certificates: %v", err)
+			} else if reloaded {
+				log.Println("🔄 Certificates changed on disk, reloaded")
+			}
+			if err := revocation.ReloadIfChanged(); err != nil {
+				log.Printf("Failed to reload CRL: %v", err)
+			}
+		}
+	}
+}
+
+// handleShutdown saves the traffic usage and exits on SIGINT or SIGTERM
+func handleShutdown(traffic *TrafficControl) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	log.Printf("🛑 %v received, shutting down", sig)
+	saveUsage(traffic)
+	os.Exit(0)
+}
+
+// saveUsage saves the traffic usage before the server exits
+func saveUsage(traffic *TrafficControl) {
+	if err := traffic.Close(); err != nil {
+		log.Printf("Failed to save traffic usage: %v", err)
+	}
+}
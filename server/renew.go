@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// serveControl answers the control streams a client opens after its handshake
+// The session's certificate authenticates every request
+func (s *TunnelServer) serveControl(session common.Session, id *ClientIdentity) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in handleControl: %v", r)
+				}
+			}()
+			s.handleControl(conn, id)
+		}(stream)
+	}
+}
+
+// handleControl dispatches a single control request
+func (s *TunnelServer) handleControl(conn net.Conn, id *ClientIdentity) {
+	defer common.CloseConn(conn)
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+
+	command, err := common.ReadLine(conn)
+	if err != nil {
+		return
+	}
+	switch command {
+	case common.RenewCommand:
+		json.NewEncoder(conn).Encode(s.renewClient(conn, id))
+	default:
+		log.Printf("Unknown control request from client %s: %q", id.Name(), command)
+	}
+}
+
+// renewClient signs a new certificate for the identity of the session
+func (s *TunnelServer) renewClient(conn net.Conn, id *ClientIdentity) common.EnrollResponse {
+	var req common.RenewRequest
+	if err := json.NewDecoder(io.LimitReader(conn, maxEnrollRequestSize)).Decode(&req); err != nil {
+		return common.EnrollResponse{Error: "invalid request"}
+	}
+	if s.renewals == nil {
+		return common.EnrollResponse{Error: "automatic renewal is disabled on the server"}
+	}
+
+	// The index only knows revocations made with utils, the CRL and the
+	// revoked_serials denylist are checked here
+	if s.revoked(id) {
+		log.Printf("🚫 Refused renewal for client %s, its certificate is revoked", id)
+		return common.EnrollResponse{Error: "certificate is revoked"}
+	}
+
+	der, err := s.renewals.RenewClient(id.Certificate, req.CSR)
+	if err != nil {
+		log.Printf("❌ Renewal for client %s failed: %v", id, err)
+		return common.EnrollResponse{Error: err.Error()}
+	}
+	chain, err := s.renewals.EncodeChain(der)
+	var ca []byte
+	if err == nil {
+		ca, err = os.ReadFile(s.renewals.Path("ca.pem"))
+	}
+	if err != nil {
+		log.Printf("Failed to read CA bundle: %v", err)
+		return common.EnrollResponse{Error: "internal error"}
+	}
+
+	log.Printf("🔁 Renewed certificate for client %s", id)
+	return common.EnrollResponse{
+		Certificate: string(chain),
+		CA:          string(ca),
+	}
+}
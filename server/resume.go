@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// newResumableStream wraps an accepted tunnel stream so it survives reconnects
+func (s *TunnelServer) newResumableStream(id uint64, stream net.Conn, pool *SessionPool) *common.ResumableConn {
+	name, clientID := pool.Identity().Name(), pool.ClientID()
+	rc := common.NewResumableConn(id, stream, pool.ResumeWindow(), func(rc *common.ResumableConn) {
+		s.resumeStream(name, clientID, rc)
+	})
+	s.resumable.Add(rc)
+	return rc
+}
+
+// resumeStream reattaches a detached stream to a live session of the same client
+// It retries until the stream's resume window has passed
+func (s *TunnelServer) resumeStream(name, clientID string, rc *common.ResumableConn) {
+	deadline := time.Now().Add(rc.Window())
+	for time.Now().Before(deadline) {
+		if rc.IsClosed() || rc.IsAttached() {
+			return
+		}
+		if pool := s.GetPool(name); pool != nil && pool.ClientID() == clientID {
+			if sess := pool.Pick(); sess != nil {
+				if err := resumeOnSession(sess, rc); err != nil {
+					log.Printf("Failed to resume stream %d: %v", rc.ID(), err)
+				} else {
+					log.Printf("🔁 Resumed stream %d", rc.ID())
+					return
+				}
+			}
+		}
+		time.Sleep(ResumeRetryInterval)
+	}
+}
+
+// resumeOnSession exchanges received offsets with the client and attaches
+func resumeOnSession(sess common.Session, rc *common.ResumableConn) error {
+	stream, err := sess.Open()
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(stream, "RESUME %d %d\n", rc.ID(), rc.Received()); err != nil {
+		common.CloseConn(stream)
+		return err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	line, err := common.ReadLine(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		common.CloseConn(stream)
+		return err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "OK" {
+		common.CloseConn(stream)
+		return fmt.Errorf("client refused resume: %q", line)
+	}
+	peerReceived, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		common.CloseConn(stream)
+		return fmt.Errorf("invalid resume offset %q", fields[1])
+	}
+
+	if err := rc.Attach(stream, peerReceived); err != nil {
+		common.CloseConn(stream)
+		return err
+	}
+	return nil
+}
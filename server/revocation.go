@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// Revocation tracks revoked client certificate serials from a CRL and a denylist
+type Revocation struct {
+	mu       sync.RWMutex
+	certs    *common.CertReloader
+	crlPath  string
+	crlMod   time.Time
+	crl      map[string]bool
+	crlGone  bool // The CRL file was removed after it was loaded
+	denylist map[string]bool
+	changed  chan struct{}
+}
+
+// NewRevocation loads the CRL signed by the CA and the denylisted serials
+// A missing CRL file means nothing is revoked by CRL
+func NewRevocation(certs *common.CertReloader, crlPath string, denylist []string) (*Revocation, error) {
+	r := &Revocation{
+		certs:   certs,
+		crlPath: crlPath,
+		changed: make(chan struct{}),
+	}
+	if err := r.SetDenylist(denylist); err != nil {
+		return nil, err
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// normalizeSerial converts a hex serial ("0A:1B", "0a1b") to the form
+// used by the certificate index
+func normalizeSerial(serial string) (string, error) {
+	n, ok := new(big.Int).SetString(strings.ReplaceAll(serial, ":", ""), 16)
+	if !ok {
+		return "", fmt.Errorf("invalid serial '%s'", serial)
+	}
+	return n.Text(16), nil
+}
+
+// SetDenylist replaces the denylisted serials
+func (r *Revocation) SetDenylist(serials []string) error {
+	denylist := make(map[string]bool, len(serials))
+	for _, s := range serials {
+		serial, err := normalizeSerial(s)
+		if err != nil {
+			return err
+		}
+		denylist[serial] = true
+	}
+
+	r.mu.Lock()
+	r.denylist = denylist
+	r.mu.Unlock()
+	r.notify()
+	return nil
+}
+
+// Reload reads the CRL file again
+// A CRL with an invalid signature is rejected and the previous one kept
+// A removed CRL also keeps the previous one, a revocation must not be
+// undone by losing the file
+func (r *Revocation) Reload() error {
+	info, err := os.Stat(r.crlPath)
+	if errors.Is(err, os.ErrNotExist) {
+		r.mu.Lock()
+		warn := r.crl != nil && !r.crlGone
+		r.crlGone = true
+		kept := len(r.crl)
+		r.mu.Unlock()
+		if warn {
+			log.Printf("⚠️ CRL %s was removed, keeping its %d revoked serials until a new CRL is written", r.crlPath, kept)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CRL: %w", err)
+	}
+
+	crl, err := r.loadCRL()
+	if err != nil {
+		// Remember the bad file so polling does not report it again
+		r.mu.Lock()
+		r.crlMod = info.ModTime()
+		r.mu.Unlock()
+		return err
+	}
+	if time.Now().After(crl.NextUpdate) && !crl.NextUpdate.IsZero() {
+		log.Printf("⚠️ CRL %s is past its next update (%s), regenerate it", r.crlPath, crl.NextUpdate.Format(time.RFC3339))
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.Text(16)] = true
+	}
+
+	r.mu.Lock()
+	r.crl, r.crlMod, r.crlGone = revoked, info.ModTime(), false
+	r.mu.Unlock()
+	r.notify()
+	log.Printf("🔒 Loaded CRL %s (%d revoked)", r.crlPath, len(revoked))
+	return nil
+}
+
+// ReloadIfChanged reloads the CRL when its modification time changed or
+// the file was removed
+func (r *Revocation) ReloadIfChanged() error {
+	info, err := os.Stat(r.crlPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return r.Reload()
+		}
+		return err
+	}
+	r.mu.RLock()
+	unchanged := info.ModTime().Equal(r.crlMod)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	return r.Reload()
+}
+
+// loadCRL parses the CRL and checks it was signed by the CA
+func (r *Revocation) loadCRL() (*x509.RevocationList, error) {
+	data, err := os.ReadFile(r.crlPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRL: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL: %w", err)
+	}
+	for _, ca := range r.certs.Issuers() {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return crl, nil
+		}
+	}
+	return nil, fmt.Errorf("CRL %s is not signed by a known CA", r.crlPath)
+}
+
+// IsRevoked checks if a serial is revoked
+func (r *Revocation) IsRevoked(serial string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.crl[serial] || r.denylist[serial]
+}
+
+// Changed returns a channel closed on the next change of the revoked serials
+func (r *Revocation) Changed() <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.changed
+}
+
+// notify wakes up everything waiting on Changed
+func (r *Revocation) notify() {
+	r.mu.Lock()
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// VerifyClient verifies a client certificate chain against the current CA
+// pool and rejects it if any certificate in it is revoked
+// It returns the serials of the verified chains, the leaf's included
+func (r *Revocation) VerifyClient(peer []*x509.Certificate) ([]string, error) {
+	rawCerts := make([][]byte, len(peer))
+	for i, cert := range peer {
+		rawCerts[i] = cert.Raw
+	}
+	chains, err := r.certs.VerifyClientChain(rawCerts)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.CheckChains(chains); err != nil {
+		return nil, err
+	}
+	var serials []string
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if serial := cert.SerialNumber.Text(16); !slices.Contains(serials, serial) {
+				serials = append(serials, serial)
+			}
+		}
+	}
+	return serials, nil
+}
+
+// AnyRevoked checks if any of the serials is revoked
+func (r *Revocation) AnyRevoked(serials []string) bool {
+	return slices.ContainsFunc(serials, r.IsRevoked)
+}
+
+// CheckChains rejects verified certificate chains containing a revoked serial
+func (r *Revocation) CheckChains(verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if serial := cert.SerialNumber.Text(16); r.IsRevoked(serial) {
+				return fmt.Errorf("certificate %s (serial %s) is revoked", cert.Subject.CommonName, serial)
+			}
+		}
+	}
+	return nil
+}
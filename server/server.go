@@ -2,71 +2,150 @@ package main
 
 import (
 	"crypto/tls"
+	"expvar"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"z44-tunnel/common"
-
-	"github.com/hashicorp/yamux"
 )
 
 // Server constants
 const (
 	TunnelPort           = ":49153"
+	DefaultWebSocketPath = "/z44"
+	DefaultCRLFile       = "certs/crl.pem"
 	PingInterval         = 5 * time.Second
 	WriteTimeout         = 10 * time.Second
 	HandshakeTimeout     = 10 * time.Second
 	KeepAlive            = 10 * time.Second
 	MaxConcurrentStreams = 1000                  // Maximum concurrent streams per session
-	StreamRateLimit      = 100                   // Maximum tokens in bucket
-	StreamRefillRate     = 10 * time.Millisecond // Refill rate (100 streams/sec max)
+	StreamRateLimit      = 100                   // Default global bucket size
+	StreamRefillRate     = 10 * time.Millisecond // Default global refill rate (100 streams/sec max)
+	MaxResumeWindow      = 60 * time.Second      // Upper bound on the client's resume window
+	ResumeRetryInterval  = 100 * time.Millisecond
+	ReloadPollInterval   = 10 * time.Second // How often certificate and CRL files are checked for changes
+	MaxHandshakeSize     = 64 << 10         // Upper bound on the client handshake, read before token authentication
 )
 
 // TunnelServer manages the server state
 type TunnelServer struct {
-	mu            sync.RWMutex
-	activeSession *yamux.Session
-	listeners     map[int]net.Listener
-	streamCount   int
-	rateLimiter   *common.RateLimiter
+	mu           sync.RWMutex
+	pools        map[string]*SessionPool // Keyed by client identity name
+	ports        map[int]string          // Owning client identity name per port
+	listeners    map[int]net.Listener
+	clients      map[string]ClientPolicy
+	revocation   *Revocation
+	renewals     *common.CertStore // Nil unless clients may renew over the tunnel
+	tokens       *TokenAuth        // Nil unless clients authenticate with tokens instead of certificates
+	trustDomain  string            // SPIFFE trust domain client certificates must belong to, empty for any
+	access       *AccessControl
+	limits       *RateLimiters
+	traffic      *TrafficControl
+	conns        *ConnectionLimits
+	streamCount  int
+	resumable    *common.ResumeRegistry
+	nextStreamID atomic.Uint64
 }
 
 // NewTunnelServer creates a new tunnel server instance
-func NewTunnelServer() *TunnelServer {
+// An empty clients map accepts every client signed by the CA (or with a token)
+// renewals is the store renewed certificates are signed with, nil disables renewal
+// tokens authenticates clients by token instead of certificate, nil requires mTLS
+// trustDomain requires client certificates with a SPIFFE ID in that trust domain
+// access decides where forwarded ports listen and who may reach them
+// limits caps how fast new connections reach the forwarded ports
+// traffic shapes their bandwidth and counts their bytes against quotas
+// conns caps their open connections per port and source address
+func NewTunnelServer(clients map[string]ClientPolicy, revocation *Revocation, renewals *common.CertStore, tokens *TokenAuth, trustDomain string, access *AccessControl, limits *RateLimiters, traffic *TrafficControl, conns *ConnectionLimits) *TunnelServer {
 	return &TunnelServer{
+		pools:       make(map[string]*SessionPool),
+		ports:       make(map[int]string),
 		listeners:   make(map[int]net.Listener),
-		rateLimiter: common.NewRateLimiter(StreamRateLimit, StreamRefillRate),
+		clients:     clients,
+		revocation:  revocation,
+		renewals:    renewals,
+		tokens:      tokens,
+		trustDomain: trustDomain,
+		access:      access,
+		limits:      limits,
+		traffic:     traffic,
+		conns:       conns,
+		resumable:   common.NewResumeRegistry(),
+	}
+}
+
+// Authorize returns the port policy of a client, or false if it may not connect
+func (s *TunnelServer) Authorize(id *ClientIdentity) (ClientPolicy, bool) {
+	if len(s.clients) == 0 {
+		return ClientPolicy{}, true
 	}
+	policy, ok := s.clients[id.Name()]
+	return policy, ok
 }
 
-// SetActiveSession sets the active yamux session
-func (s *TunnelServer) SetActiveSession(session *yamux.Session) {
+// AddSession adds a session to the pool of its client
+// A session from a new process of the same client (different client ID)
+// replaces that client's pool, other clients are left alone
+func (s *TunnelServer) AddSession(id *ClientIdentity, clientID string, resumeWindow time.Duration, session common.Session) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.activeSession != nil {
-		s.activeSession.Close()
+	name := id.Name()
+	if pool := s.pools[name]; pool != nil {
+		if clientID != "" && pool.ClientID() == clientID {
+			pool.Add(session)
+			return
+		}
+		pool.Close()
 	}
-	s.activeSession = session
-	s.streamCount = 0
+	pool := NewSessionPool(id, clientID, resumeWindow)
+	pool.Add(session)
+	s.pools[name] = pool
 }
 
-// GetActiveSession returns the active yamux session
-func (s *TunnelServer) GetActiveSession() *yamux.Session {
+// GetPool returns the session pool of a client
+func (s *TunnelServer) GetPool(name string) *SessionPool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.activeSession
+	return s.pools[name]
+}
+
+// GetPortPool returns the session pool of the client owning a port
+func (s *TunnelServer) GetPortPool(port int) *SessionPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner, ok := s.ports[port]
+	if !ok {
+		return nil
+	}
+	return s.pools[owner]
+}
+
+// ClaimPort assigns a port to a client
+// A port stays with its owner while the owner is connected
+func (s *TunnelServer) ClaimPort(port int, name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.ports[port]; ok && owner != name && s.pools[owner] != nil {
+		return owner, false
+	}
+	s.ports[port] = name
+	return name, true
 }
 
-// ClearActiveSession clears the active session if it matches
-func (s *TunnelServer) ClearActiveSession(session *yamux.Session) {
+// RemoveSession removes a session and drops its client's pool once it is empty
+func (s *TunnelServer) RemoveSession(name string, session common.Session) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.activeSession == session {
-		s.activeSession = nil
-		s.streamCount = 0
+	pool := s.pools[name]
+	if pool == nil || !pool.Contains(session) {
+		return
+	}
+	if pool.Remove(session) == 0 {
+		delete(s.pools, name)
 	}
 }
 
@@ -117,23 +196,121 @@ func main() {
 		}
 	}()
 
-	// Load TLS configuration
-	tlsConfig, err := LoadTLSConfig()
+	// Load configuration
+	cfg, err := LoadConfig("config.json")
 	if err != nil {
-		log.Fatalf("Failed to load TLS configuration: %v", err)
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Load server certificate and CA bundle
+	certs, err := LoadCertificates(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	// Load revoked certificates
+	// Tokens have no serial, they are revoked by removing them from the config
+	crlFile := cfg.CRLFile
+	if cfg.Auth == AuthToken {
+		crlFile = ""
+	}
+	revocation, err := NewRevocation(certs, crlFile, cfg.RevokedSerials)
+	if err != nil {
+		log.Fatalf("Failed to load revocation list: %v", err)
+	}
+
+	// Token authentication replaces client certificates
+	var tokens *TokenAuth
+	if cfg.Auth == AuthToken {
+		if tokens, err = NewTokenAuth(cfg.Tokens); err != nil {
+			log.Fatalf("Failed to load tokens: %v", err)
+		}
+		log.Printf("🔑 Clients authenticate with tokens (%d configured)", len(cfg.Tokens))
 	}
 
+	tlsSettings, _ := cfg.TLS.Resolve()
+	log.Printf("🔐 TLS policy: %s", tlsSettings)
+	tlsConfig := NewTLSConfig(certs, revocation, tokens, tlsSettings)
+
 	// Start TLS listener
-	ln, err := tls.Listen("tcp", TunnelPort, tlsConfig)
+	ln, err := tls.Listen("tcp", cfg.TunnelAddr, tlsConfig)
 	if err != nil {
-		log.Fatalf("Failed to start TLS listener on %s: %v", TunnelPort, err)
+		log.Fatalf("Failed to start TLS listener on %s: %v", cfg.TunnelAddr, err)
 	}
 	defer common.CloseListener(ln)
 
-	log.Printf("🚀 Server ready on %s", TunnelPort)
+	log.Printf("🚀 Server ready on %s", cfg.TunnelAddr)
+
+	// Enrollment and renewal sign with the CA key in certs/ and share its index
+	store := common.NewCertStore("certs")
+	caPassphrase, _ := common.ParsePassphrase(cfg.CAKeyPassphrase)
+	store.SetPassphrase(caPassphrase)
+	var renewals *common.CertStore
+	if cfg.AutoRenew {
+		if !store.HasCA() {
+			log.Fatalf("auto_renew needs the CA certificate and key in certs/")
+		}
+		renewals = store
+	}
+
+	// Port listen addresses and source address lists
+	access, err := NewAccessControl(cfg.Ports)
+	if err != nil {
+		log.Fatalf("Failed to load port policies: %v", err)
+	}
+
+	// Connections refused by rate and connection limits are summed up in the log
+	rejections := NewRejectionLog()
+	go rejections.Run()
+
+	// Connection rate limits per source address, port, client and overall
+	limits, err := NewRateLimiters(cfg.RateLimits, rejections)
+	if err != nil {
+		log.Fatalf("Failed to load rate limits: %v", err)
+	}
+
+	// Open connection limits per port and source address
+	conns := NewConnectionLimits(cfg.Ports, cfg.MaxConnectionsPerIP, rejections)
+	expvar.Publish("open_connections", expvar.Func(conns.Snapshot))
+
+	// Bandwidth limits and monthly quotas per port and client
+	traffic, err := NewTrafficControl(cfg.UsageFile, cfg.Ports, cfg.Clients)
+	if err != nil {
+		log.Fatalf("Failed to load traffic limits: %v", err)
+	}
+	expvar.Publish("traffic", expvar.Func(traffic.Snapshot))
+	go traffic.Run()
+
+	// Save the byte counts when the server stops, on a signal or when the
+	// listener closes
+	go handleShutdown(traffic)
+	defer saveUsage(traffic)
 
 	// Create server instance
-	server := NewTunnelServer()
+	server := NewTunnelServer(cfg.Clients, revocation, renewals, tokens, cfg.TrustDomain, access, limits, traffic, conns)
+
+	// Reload certificates, revocations, tokens, port policies and limits on SIGHUP and file changes
+	go handleReloads("config.json", certs, revocation, tokens, access, limits, traffic, conns)
+
+	// Start optional WebSocket endpoint
+	if cfg.WebSocketAddr != "" {
+		go serveWebSocket(cfg.WebSocketAddr, cfg.WebSocketPath, tlsConfig, server)
+	}
+
+	// Start optional metrics endpoint
+	if cfg.AdminAddr != "" {
+		go common.ServeAdmin(cfg.AdminAddr)
+	}
+
+	// Start optional enrollment endpoint
+	if cfg.EnrollAddr != "" {
+		go serveEnrollment(cfg.EnrollAddr, certs, store, tlsSettings)
+	}
+
+	// Start optional QUIC endpoint
+	if cfg.QUICAddr != "" {
+		go serveQUIC(cfg.QUICAddr, tlsConfig, server)
+	}
 
 	// Main accept loop
 	for {
@@ -150,13 +327,13 @@ func main() {
 		}
 
 		common.SetKeepAlive(conn, KeepAlive)
-		go func(c net.Conn) {
+		go func(c *tls.Conn) {
 			defer func() {
 				if r := recover(); r != nil {
 					log.Printf("Panic in handleClient: %v", r)
 				}
 			}()
-			handleClient(c, server)
-		}(conn)
+			handleTLSClient(c, server)
+		}(conn.(*tls.Conn))
 	}
 }
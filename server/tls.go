@@ -2,31 +2,54 @@ package main
 
 import (
 	"crypto/tls"
-	"fmt"
 
 	"z44-tunnel/common"
 )
 
-// LoadTLSConfig loads the TLS configuration for the server
-func LoadTLSConfig() (*tls.Config, error) {
-	// Load CA certificate pool
-	caPool, err := common.LoadCACertPool("certs/ca.pem")
+// LoadCertificates loads the server certificate, its key and the CA bundle
+// The key comes from key_source, by default certs/server-key.pem
+// Token authentication needs no CA bundle, the certificate may come from any CA
+func LoadCertificates(cfg *Config) (*common.CertReloader, error) {
+	passphrase, err := common.ParsePassphrase(cfg.KeyPassphrase)
 	if err != nil {
 		return nil, err
 	}
-
-	// Load server certificate
-	cert, err := common.LoadCertKeyPair("certs/server-cert.pem", "certs/server-key.pem")
+	key, err := common.ParseKeySource(cfg.KeySource, "certs/server-key.pem", passphrase)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+		return nil, err
+	}
+	caPath := "certs/ca.pem"
+	if cfg.Auth == AuthToken {
+		caPath = ""
 	}
+	return common.NewCertReloader("certs/server-cert.pem", key, caPath)
+}
 
-	return &tls.Config{
-		Certificates:             []tls.Certificate{cert},
-		ClientCAs:                caPool,
-		ClientAuth:               tls.RequireAndVerifyClientCert,
-		MinVersion:               tls.VersionTLS12,
-		CipherSuites:             common.GetSecureCipherSuites(),
+// NewTLSConfig creates the TLS configuration for the server
+// The certificate and CA pool are read from certs on every handshake, so
+// reloading them applies to new connections without a restart
+// With tokens, clients send no certificate and authenticate in the handshake
+// settings is the TLS policy of the config
+func NewTLSConfig(certs *common.CertReloader, revocation *Revocation, tokens *TokenAuth, settings *common.TLSSettings) *tls.Config {
+	if tokens != nil {
+		return settings.Apply(&tls.Config{
+			GetCertificate:           certs.GetCertificate,
+			ClientAuth:               tls.NoClientCert,
+			PreferServerCipherSuites: true,
+		})
+	}
+	return settings.Apply(&tls.Config{
+		GetCertificate: certs.GetCertificate,
+		// The chain is verified below against the current CA pool
+		// instead of a ClientCAs pool fixed at startup
+		ClientAuth: tls.RequireAnyClientCert,
+		// VerifyConnection also runs when a session ticket is resumed,
+		// unlike VerifyPeerCertificate, so a revoked client or one whose
+		// CA left the bundle cannot skip the checks with an old ticket
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, err := revocation.VerifyClient(state.PeerCertificates)
+			return err
+		},
 		PreferServerCipherSuites: true,
-	}, nil
+	})
 }
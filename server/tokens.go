@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"z44-tunnel/common"
+)
+
+// Authentication modes
+const (
+	AuthMTLS  = "mtls"  // Clients present a certificate signed by the CA
+	AuthToken = "token" // Clients send a secret token in their handshake
+)
+
+// TokenAuth authenticates clients by the token in their handshake
+// Only SHA-256 hashes of the tokens are kept, keyed by client name
+type TokenAuth struct {
+	mu      sync.RWMutex
+	hashes  map[string][]byte
+	changed chan struct{}
+}
+
+// NewTokenAuth creates the token authenticator from the configured hashes
+func NewTokenAuth(tokens map[string]string) (*TokenAuth, error) {
+	a := &TokenAuth{changed: make(chan struct{})}
+	if err := a.SetTokens(tokens); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseTokenHash decodes a hex SHA-256 token hash as written by "utils auth-token"
+func parseTokenHash(hash string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(hash), "sha256:"))
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("invalid token hash '%s', expected 64 hex characters", hash)
+	}
+	return b, nil
+}
+
+// SetTokens replaces the accepted tokens
+// Sessions of tokens that were removed or changed are closed, see Accepts
+func (a *TokenAuth) SetTokens(tokens map[string]string) error {
+	hashes := make(map[string][]byte, len(tokens))
+	for name, hash := range tokens {
+		if name == "" {
+			return errors.New("token with an empty client name")
+		}
+		b, err := parseTokenHash(hash)
+		if err != nil {
+			return fmt.Errorf("client '%s': %w", name, err)
+		}
+		hashes[name] = b
+	}
+
+	a.mu.Lock()
+	a.hashes = hashes
+	close(a.changed)
+	a.changed = make(chan struct{})
+	a.mu.Unlock()
+	return nil
+}
+
+// Changed returns a channel closed on the next change of the tokens
+func (a *TokenAuth) Changed() <-chan struct{} {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.changed
+}
+
+// Accepts checks if the token a client authenticated with is still configured
+func (a *TokenAuth) Accepts(id *ClientIdentity) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return subtle.ConstantTimeCompare(a.hashes[id.Name()], id.token) == 1
+}
+
+// Authenticate returns the identity a token belongs to
+// Every hash is compared in constant time
+func (a *TokenAuth) Authenticate(token string) (*ClientIdentity, error) {
+	if token == "" {
+		return nil, errors.New("no token in handshake")
+	}
+	sum, _ := hex.DecodeString(common.HashToken(token))
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var name string
+	for n, hash := range a.hashes {
+		if subtle.ConstantTimeCompare(sum, hash) == 1 {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, errors.New("unknown token")
+	}
+	return &ClientIdentity{CommonName: name, token: sum}, nil
+}
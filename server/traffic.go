@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// Traffic accounting settings
+const (
+	DefaultUsageFile   = "usage.json" // Where the monthly byte counts survive restarts
+	UsageSaveInterval  = time.Minute  // How often the byte counts are saved and the month checked
+	usageMonthLayout   = "2006-01"
+	maxTrafficEntities = 1 << 16 // Upper bound on the clients counted, ports are bounded anyway
+)
+
+// BandwidthLimit caps the throughput of a port or client, as a size per
+// second such as "2MB" or "20Mbit"
+type BandwidthLimit struct {
+	Upload   string `json:"upload,omitempty"`   // From the client's services to the public side
+	Download string `json:"download,omitempty"` // From the public side to the client's services
+}
+
+// trafficLimits is a checked bandwidth limit and monthly quota, in bytes
+type trafficLimits struct {
+	upload   int64
+	download int64
+	quota    int64
+}
+
+// parseTrafficLimits checks the bandwidth and quota of a port or client policy
+func parseTrafficLimits(bandwidth *BandwidthLimit, quota string) (trafficLimits, error) {
+	var l trafficLimits
+	var err error
+	if bandwidth != nil {
+		if l.upload, err = common.ParseByteSize(bandwidth.Upload); err != nil {
+			return l, fmt.Errorf("bandwidth.upload: %w", err)
+		}
+		if l.download, err = common.ParseByteSize(bandwidth.Download); err != nil {
+			return l, fmt.Errorf("bandwidth.download: %w", err)
+		}
+	}
+	if l.quota, err = common.ParseByteSize(quota); err != nil {
+		return l, fmt.Errorf("monthly_quota: %w", err)
+	}
+	return l, nil
+}
+
+// trafficEntry is the bandwidth, quota and usage of a port or a client
+// Entries are updated in place on reload, so open connections follow
+type trafficEntry struct {
+	label     string
+	upload    *common.ByteLimiter
+	download  *common.ByteLimiter
+	quota     atomic.Int64 // Bytes per month, 0 for none
+	used      atomic.Int64 // Bytes this month, both directions
+	rejected  atomic.Int64 // Connections refused this month
+	exhausted atomic.Bool  // Set once the quota was reached and logged
+}
+
+// newTrafficEntry creates an unlimited entry
+func newTrafficEntry(label string) *trafficEntry {
+	return &trafficEntry{label: label, upload: common.NewByteLimiter(0), download: common.NewByteLimiter(0)}
+}
+
+// set applies limits to the entry
+func (e *trafficEntry) set(l trafficLimits) {
+	e.upload.SetRate(l.upload)
+	e.download.SetRate(l.download)
+	e.quota.Store(l.quota)
+	if l.quota == 0 || e.used.Load() < l.quota {
+		e.exhausted.Store(false)
+	}
+}
+
+// allow checks the monthly quota for a new connection, the first refusal is logged
+func (e *trafficEntry) allow() bool {
+	if e.withinQuota() {
+		return true
+	}
+	e.rejected.Add(1)
+	return false
+}
+
+// withinQuota checks if the monthly quota has bytes left, the first time it
+// has none is logged
+func (e *trafficEntry) withinQuota() bool {
+	quota := e.quota.Load()
+	if quota == 0 || e.used.Load() < quota {
+		return true
+	}
+	if !e.exhausted.Swap(true) {
+		log.Printf("📵 %s used its monthly quota of %s, refusing and closing its connections until next month", e.label, common.FormatBytes(quota))
+	}
+	return false
+}
+
+// reset starts a new month
+func (e *trafficEntry) reset() {
+	e.used.Store(0)
+	e.rejected.Store(0)
+	e.exhausted.Store(false)
+}
+
+// trafficStats is how an entry shows in the traffic metric
+type trafficStats struct {
+	Bytes         int64 `json:"bytes"`
+	Quota         int64 `json:"quota,omitempty"`
+	Rejected      int64 `json:"rejected,omitempty"`
+	UploadLimit   int64 `json:"upload_limit,omitempty"`
+	DownloadLimit int64 `json:"download_limit,omitempty"`
+}
+
+// stats returns the metric of the entry
+func (e *trafficEntry) stats() trafficStats {
+	return trafficStats{
+		Bytes:         e.used.Load(),
+		Quota:         e.quota.Load(),
+		Rejected:      e.rejected.Load(),
+		UploadLimit:   e.upload.Rate(),
+		DownloadLimit: e.download.Rate(),
+	}
+}
+
+// usageFile is the saved byte counts of the current month
+type usageFile struct {
+	Month   string           `json:"month"`
+	Ports   map[int]int64    `json:"ports"`
+	Clients map[string]int64 `json:"clients"`
+}
+
+// TrafficControl shapes the bandwidth of forwarded connections per port and
+// per client, and counts their bytes against monthly quotas
+// Months follow UTC, the counts are saved to usagePath so a restart keeps them
+type TrafficControl struct {
+	mu        sync.Mutex
+	usagePath string
+	month     string
+	ports     map[int]*trafficEntry
+	clients   map[string]*trafficEntry
+	saved     int64      // Total bytes at the last save
+	saveMu    sync.Mutex // Keeps a shutdown save from racing the periodic one
+}
+
+// NewTrafficControl creates the traffic control from the port and client
+// policies and loads this month's byte counts
+func NewTrafficControl(usagePath string, ports map[int]PortPolicy, clients map[string]ClientPolicy) (*TrafficControl, error) {
+	t := &TrafficControl{
+		usagePath: usagePath,
+		month:     time.Now().UTC().Format(usageMonthLayout),
+		ports:     make(map[int]*trafficEntry),
+		clients:   make(map[string]*trafficEntry),
+	}
+	if err := t.SetPolicies(ports, clients); err != nil {
+		return nil, err
+	}
+	if err := t.load(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", usagePath, err)
+	}
+	return t, nil
+}
+
+// load restores the byte counts saved this month
+func (t *TrafficControl) load() error {
+	data, err := os.ReadFile(t.usagePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var usage usageFile
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return err
+	}
+	if usage.Month != t.month {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for port, n := range usage.Ports {
+		t.portEntry(port).used.Store(n)
+		t.saved += n
+	}
+	for name, n := range usage.Clients {
+		t.clientEntry(name).used.Store(n)
+		t.saved += n
+	}
+	return nil
+}
+
+// SetPolicies applies the bandwidth limits and quotas of the port and
+// client policies, open connections follow the new limits
+func (t *TrafficControl) SetPolicies(ports map[int]PortPolicy, clients map[string]ClientPolicy) error {
+	portLimits := make(map[int]trafficLimits, len(ports))
+	for port, p := range ports {
+		l, err := parseTrafficLimits(p.Bandwidth, p.MonthlyQuota)
+		if err != nil {
+			return fmt.Errorf("port %d: %w", port, err)
+		}
+		portLimits[port] = l
+	}
+	clientLimits := make(map[string]trafficLimits, len(clients))
+	for name, p := range clients {
+		l, err := parseTrafficLimits(p.Bandwidth, p.MonthlyQuota)
+		if err != nil {
+			return fmt.Errorf("client '%s': %w", name, err)
+		}
+		clientLimits[name] = l
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for port, e := range t.ports {
+		if _, ok := portLimits[port]; !ok {
+			e.set(trafficLimits{})
+		}
+	}
+	for name, e := range t.clients {
+		if _, ok := clientLimits[name]; !ok {
+			e.set(trafficLimits{})
+		}
+	}
+	for port, l := range portLimits {
+		t.portEntry(port).set(l)
+	}
+	for name, l := range clientLimits {
+		t.clientEntry(name).set(l)
+	}
+	return nil
+}
+
+// portEntry returns the entry of a port, creating it if needed
+// The caller holds t.mu
+func (t *TrafficControl) portEntry(port int) *trafficEntry {
+	e, ok := t.ports[port]
+	if !ok {
+		e = newTrafficEntry(fmt.Sprintf("Port %d", port))
+		t.ports[port] = e
+	}
+	return e
+}
+
+// clientEntry returns the entry of a client, creating it if needed
+// Past maxTrafficEntities, new clients get an unlimited entry that is not kept
+// The caller holds t.mu
+func (t *TrafficControl) clientEntry(name string) *trafficEntry {
+	e, ok := t.clients[name]
+	if !ok {
+		e = newTrafficEntry("Client " + name)
+		if len(t.clients) < maxTrafficEntities {
+			t.clients[name] = e
+		}
+	}
+	return e
+}
+
+// entries returns the entries of a port and its owning client
+func (t *TrafficControl) entries(port int, client string) (*trafficEntry, *trafficEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.portEntry(port), t.clientEntry(client)
+}
+
+// Allow checks the monthly quotas of a port and of the client owning it
+func (t *TrafficControl) Allow(port int, client string) bool {
+	portEntry, clientEntry := t.entries(port, client)
+	return portEntry.allow() && clientEntry.allow()
+}
+
+// Shape wraps a public connection to a port so its bytes are throttled by
+// the bandwidth limits of the port and the client, and counted for both
+// Writes to the public side are uploads, reads are downloads
+// The connection fails with common.ErrQuotaExceeded once either monthly
+// quota is used up, so long-lived connections cannot run past it
+func (t *TrafficControl) Shape(conn net.Conn, port int, client string) net.Conn {
+	portEntry, clientEntry := t.entries(port, client)
+	return common.NewShapedConn(conn,
+		[]*common.ByteLimiter{portEntry.download, clientEntry.download},
+		[]*common.ByteLimiter{portEntry.upload, clientEntry.upload},
+		func() bool { return portEntry.withinQuota() && clientEntry.withinQuota() },
+		&portEntry.used, &clientEntry.used)
+}
+
+// Snapshot returns the usage of every port and client for the traffic metric
+func (t *TrafficControl) Snapshot() any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ports := make(map[int]trafficStats, len(t.ports))
+	for port, e := range t.ports {
+		ports[port] = e.stats()
+	}
+	clients := make(map[string]trafficStats, len(t.clients))
+	for name, e := range t.clients {
+		clients[name] = e.stats()
+	}
+	return map[string]any{"month": t.month, "ports": ports, "clients": clients}
+}
+
+// Run saves the byte counts periodically and resets them when a month begins
+func (t *TrafficControl) Run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in TrafficControl: %v", r)
+		}
+	}()
+
+	ticker := time.NewTicker(UsageSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.save(); err != nil {
+			log.Printf("Failed to save traffic usage: %v", err)
+		}
+	}
+}
+
+// Close saves the byte counts on shutdown, so a restart loses none of them
+func (t *TrafficControl) Close() error {
+	return t.save()
+}
+
+// save writes the byte counts if they changed, and starts a new month once
+// the current one is over
+func (t *TrafficControl) save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	month := time.Now().UTC().Format(usageMonthLayout)
+	if month != t.month {
+		for _, e := range t.ports {
+			e.reset()
+		}
+		for _, e := range t.clients {
+			e.reset()
+		}
+		log.Printf("📅 Traffic counters reset for %s", month)
+		t.month = month
+		t.saved = -1
+	}
+	usage := usageFile{Month: t.month, Ports: make(map[int]int64), Clients: make(map[string]int64)}
+	var total int64
+	for port, e := range t.ports {
+		if n := e.used.Load(); n > 0 {
+			usage.Ports[port] = n
+			total += n
+		}
+	}
+	for name, e := range t.clients {
+		if n := e.used.Load(); n > 0 {
+			usage.Clients[name] = n
+			total += n
+		}
+	}
+	unchanged := total == t.saved
+	t.saved = total
+	t.mu.Unlock()
+
+	if unchanged {
+		return nil
+	}
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err == nil {
+		err = common.WriteFileAtomic(t.usagePath, data, 0644)
+	}
+	if err != nil {
+		t.mu.Lock()
+		t.saved = -1 // Retry on the next tick
+		t.mu.Unlock()
+	}
+	return err
+}
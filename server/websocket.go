@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"z44-tunnel/common"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsAddr is the remote address of a WebSocket tunnel connection
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// wsConn carries the HTTP peer address, websocket.Conn only knows the origin
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the address of the HTTP client
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// serveWebSocket accepts tunnel connections upgraded from HTTPS
+// The TLS config is shared with the raw listener so client certificates
+// are verified during the HTTPS handshake exactly as on the tunnel port
+func serveWebSocket(addr, path string, tlsConfig *tls.Config, server *TunnelServer) {
+	wsServer := websocket.Server{
+		// Clients authenticate with mTLS or a token, the Origin header carries no trust
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in handleClient: %v", r)
+				}
+			}()
+			ws.PayloadType = websocket.BinaryFrame
+			r := ws.Request()
+			if r.TLS == nil {
+				common.CloseConn(ws)
+				return
+			}
+			id, err := server.identify(*r.TLS)
+			if err != nil {
+				log.Printf("Rejected WebSocket connection from %s: %v", r.RemoteAddr, err)
+				common.CloseConn(ws)
+				return
+			}
+			handleClient(&wsConn{Conn: ws, remote: wsAddr(r.RemoteAddr)}, *r.TLS, id, server)
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, wsServer)
+
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: HandshakeTimeout,
+		// WebSocket upgrades require HTTP/1.1
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+
+	log.Printf("🌐 WebSocket endpoint ready on %s%s", addr, path)
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+		log.Printf("WebSocket endpoint stopped: %v", err)
+	}
+}
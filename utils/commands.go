@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// cmdInitCA creates the private CA
+func cmdInitCA(args []string) error {
+	fs := flag.NewFlagSet("init-ca", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	cn := fs.String("cn", defaultCAName, "CA common name")
+	keyAlgorithm := fs.String("key", common.DefaultKeyAlgorithm, keyAlgorithmUsage)
+	days := fs.Int("days", defaultValidityDays, "validity in days")
+	force := fs.Bool("force", false, "replace an existing CA (invalidates every issued certificate)")
+	passphrase := fs.String("passphrase", "", "encrypt the CA key with a passphrase from "+passphraseUsage)
+	fs.Parse(args)
+
+	store, err := openStore(*dir, *passphrase)
+	if err != nil {
+		return err
+	}
+	if store.HasCA() && !*force {
+		return fmt.Errorf("CA already exists in %s (use --force to replace it)", *dir)
+	}
+	if err := store.InitCA(*cn, *keyAlgorithm, *days); err != nil {
+		return err
+	}
+	fmt.Printf("✅ CA created in '%s/' folder. Keep ca-key.pem private.\n", *dir)
+	return nil
+}
+
+// cmdInitIntermediate creates an intermediate CA that issues certificates in
+// place of a root kept offline
+func cmdInitIntermediate(args []string) error {
+	fs := flag.NewFlagSet("init-intermediate", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	root := fs.String("root", "", "directory of the root CA (ca.pem, ca-key.pem), e.g. on removable media")
+	cn := fs.String("cn", defaultIntermediate, "intermediate CA common name")
+	keyAlgorithm := fs.String("key", common.DefaultKeyAlgorithm, keyAlgorithmUsage)
+	days := fs.Int("days", defaultIntermediateDays, "validity in days (capped at the root's expiry)")
+	force := fs.Bool("force", false, "replace an existing intermediate CA")
+	passphrase := fs.String("passphrase", "", "encrypt the intermediate key with a passphrase from "+passphraseUsage)
+	rootPassphrase := fs.String("root-passphrase", defaultRootPassphrase, "passphrase of an encrypted root key, from "+passphraseUsage)
+	fs.Parse(args)
+
+	if *root == "" {
+		return fmt.Errorf("--root is required")
+	}
+	store, err := openStore(*dir, *passphrase)
+	if err != nil {
+		return err
+	}
+	rootStore, err := openStore(*root, *rootPassphrase)
+	if err != nil {
+		return err
+	}
+	if store.HasIntermediate() && !*force {
+		return fmt.Errorf("intermediate CA already exists in %s (use --force to replace it)", *dir)
+	}
+	if err := store.InitIntermediate(rootStore, *cn, *keyAlgorithm, *days); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Intermediate CA created in '%s/' folder, new certificates are issued with it.\n", *dir)
+	if _, err := os.Stat(store.Path("ca-key.pem")); err == nil {
+		fmt.Printf("⚠️ %s still holds the root key, move it offline.\n", store.Path("ca-key.pem"))
+	}
+	return nil
+}
+
+// cmdIssueServer issues the server certificate
+func cmdIssueServer(args []string) error {
+	fs := flag.NewFlagSet("issue-server", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	addr := fs.String("addr", os.Getenv("SERVER_ADDR"), "server IPs or domains, comma separated")
+	keyAlgorithm := fs.String("key", common.DefaultKeyAlgorithm, keyAlgorithmUsage)
+	out := fs.String("out", "", "output directory (default <dir>), e.g. to stage a new key whose pin clients must learn first")
+	days := fs.Int("days", defaultValidityDays, "validity in days")
+	passphrase := fs.String("passphrase", "", "encrypt the key with a passphrase from "+passphraseUsage)
+	caPassphrase := fs.String("ca-passphrase", defaultCAPassphrase, "passphrase of an encrypted CA key, from "+passphraseUsage)
+	fs.Parse(args)
+
+	if strings.TrimSpace(*addr) == "" {
+		return fmt.Errorf("--addr is required")
+	}
+	store, err := openStore(*dir, *caPassphrase)
+	if err != nil {
+		return err
+	}
+	keyPassphrase, err := common.ParsePassphrase(*passphrase)
+	if err != nil {
+		return err
+	}
+	outDir := *out
+	if outDir == "" {
+		outDir = *dir
+	}
+	return issueServer(store, *addr, *keyAlgorithm, outDir, *days, keyPassphrase)
+}
+
+// cmdIssueClient issues a client certificate
+func cmdIssueClient(args []string) error {
+	fs := flag.NewFlagSet("issue-client", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	name := fs.String("name", "", "client name, used as the certificate CN (default: last segment of a SPIFFE --uri)")
+	uri := fs.String("uri", "", "optional URI SAN identifying the client (e.g. urn:z44:site-a or spiffe://z44/site/site-a)")
+	keyAlgorithm := fs.String("key", common.DefaultKeyAlgorithm, keyAlgorithmUsage)
+	out := fs.String("out", "", "output directory (default <dir>/clients/<name>)")
+	days := fs.Int("days", defaultValidityDays, "validity in days")
+	force := fs.Bool("force", false, "issue even if the client has an active certificate")
+	passphrase := fs.String("passphrase", "", "encrypt the key with a passphrase from "+passphraseUsage)
+	caPassphrase := fs.String("ca-passphrase", defaultCAPassphrase, "passphrase of an encrypted CA key, from "+passphraseUsage)
+	fs.Parse(args)
+
+	if *name == "" && common.IsSPIFFEID(*uri) {
+		*name = common.SPIFFEName(*uri)
+	}
+	if *name == "" {
+		return fmt.Errorf("--name is required")
+	}
+	store, err := openStore(*dir, *caPassphrase)
+	if err != nil {
+		return err
+	}
+	keyPassphrase, err := common.ParsePassphrase(*passphrase)
+	if err != nil {
+		return err
+	}
+	outDir := *out
+	if outDir == "" {
+		outDir = filepath.Join(*dir, "clients", *name)
+	}
+	return issueClient(store, *name, *uri, *keyAlgorithm, outDir, *days, *force, keyPassphrase)
+}
+
+// cmdIssueToken creates a one-time token a new client enrolls with
+func cmdIssueToken(args []string) error {
+	fs := flag.NewFlagSet("issue-token", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	name := fs.String("name", "", "client name, used as the certificate CN (default: last segment of a SPIFFE --uri)")
+	uri := fs.String("uri", "", "optional URI SAN identifying the client (e.g. urn:z44:site-a or spiffe://z44/site/site-a)")
+	days := fs.Int("days", defaultValidityDays, "validity of the enrolled certificate in days")
+	ttl := fs.Duration("ttl", defaultTokenTTL, "how long the token can be used")
+	fs.Parse(args)
+
+	if *name == "" && common.IsSPIFFEID(*uri) {
+		*name = common.SPIFFEName(*uri)
+	}
+	if *name == "" {
+		return fmt.Errorf("--name is required")
+	}
+	token, err := common.NewCertStore(*dir).AddToken(*name, *uri, *days, *ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Enrollment token for '%s' (valid for %s, single use):\n\n%s\n\n", *name, *ttl, token)
+	fmt.Println("On the new client, with certs/ca.pem and config.json in place, run:")
+	fmt.Printf("  go run ./client enroll --token %s\n", token)
+	return nil
+}
+
+// cmdAuthToken creates a token a client authenticates with instead of a
+// certificate, only its hash goes into the server config
+func cmdAuthToken(args []string) error {
+	fs := flag.NewFlagSet("auth-token", flag.ExitOnError)
+	name := fs.String("name", "", "client name, used as its identity")
+	out := fs.String("out", "", "write the token to this file instead of printing it")
+	fs.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("--name is required")
+	}
+	token, err := common.NewToken()
+	if err != nil {
+		return err
+	}
+
+	source := "file:certs/token"
+	if *out != "" {
+		if err := common.WriteFileAtomic(*out, []byte(token+"\n"), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Token for '%s' written to %s\n", *name, *out)
+		source = "file:" + *out
+	} else {
+		fmt.Printf("✅ Token for '%s' (keep it secret, it is not stored):\n\n%s\n\n", *name, token)
+	}
+	fmt.Println("Add its hash to the server config.json (\"auth\": \"token\"):")
+	fmt.Printf("  \"tokens\": { %q: %q }\n", *name, common.HashToken(token))
+	fmt.Println("and point the client config.json at the token:")
+	fmt.Printf("  \"token\": %q\n", source)
+	return nil
+}
+
+// cmdList prints every certificate in the index
+func cmdList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	fs.Parse(args)
+
+	idx, err := common.NewCertStore(*dir).LoadIndex()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tTYPE\tNAME\tEXPIRES\tSTATUS\tFILE")
+	for _, e := range idx.Certs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Serial, e.Type, e.Name, e.NotAfter.Format("2006-01-02"), e.Status(now), e.CertFile)
+	}
+	return w.Flush()
+}
+
+// cmdRevoke revokes a certificate and regenerates the CRL
+func cmdRevoke(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	serial := fs.String("serial", "", "serial number (hex) of the certificate")
+	name := fs.String("name", "", "name of the active certificate")
+	caPassphrase := fs.String("ca-passphrase", defaultCAPassphrase, "passphrase of an encrypted CA key, from "+passphraseUsage)
+	fs.Parse(args)
+
+	store, err := openStore(*dir, *caPassphrase)
+	if err != nil {
+		return err
+	}
+	var entry common.IndexEntry
+	if err := store.UpdateIndex(func(idx *common.Index) error {
+		e, err := idx.Find(strings.ToLower(*serial), *name)
+		if err != nil {
+			return err
+		}
+		if e.RevokedAt != nil {
+			return fmt.Errorf("certificate %s is already revoked", e.Serial)
+		}
+		now := time.Now()
+		e.RevokedAt = &now
+		entry = *e
+		return store.WriteCRL(idx)
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("✅ Revoked %s certificate '%s' (serial %s), CRL updated in %s\n",
+		entry.Type, entry.Name, entry.Serial, store.Path("crl.pem"))
+	return nil
+}
+
+// cmdRenew re-issues a certificate with the same identity
+func cmdRenew(args []string) error {
+	fs := flag.NewFlagSet("renew", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	serial := fs.String("serial", "", "serial number (hex) of the certificate")
+	name := fs.String("name", "", "name of the active certificate")
+	days := fs.Int("days", 0, "validity in days (default: same as the old certificate)")
+	passphrase := fs.String("passphrase", "", "passphrase of an encrypted key, from "+passphraseUsage)
+	caPassphrase := fs.String("ca-passphrase", defaultCAPassphrase, "passphrase of an encrypted CA key, from "+passphraseUsage)
+	fs.Parse(args)
+
+	store, err := openStore(*dir, *caPassphrase)
+	if err != nil {
+		return err
+	}
+	keyPassphrase, err := common.ParsePassphrase(*passphrase)
+	if err != nil {
+		return err
+	}
+	idx, err := store.LoadIndex()
+	if err != nil {
+		return err
+	}
+	entry, err := idx.Find(strings.ToLower(*serial), *name)
+	if err != nil {
+		return err
+	}
+	if !entry.Active() {
+		return fmt.Errorf("certificate %s is %s", entry.Serial, entry.Status(time.Now()))
+	}
+	if entry.CertFile == "" {
+		return fmt.Errorf("certificate %s was enrolled by its client, which holds the key", entry.Serial)
+	}
+	if entry.Type == common.CertTypeIntermediate {
+		return fmt.Errorf("certificate %s is an intermediate CA, replace it with init-intermediate --force", entry.Serial)
+	}
+	return renew(store, *entry, *days, keyPassphrase)
+}
+
+// cmdInspect prints the details of a certificate file
+func cmdInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	dir := fs.String("dir", defaultDir, "certificate directory")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: inspect [--dir certs] <cert.pem>")
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	idx, err := common.NewCertStore(*dir).LoadIndex()
+	if err != nil {
+		return err
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		printCertificate(cert, idx)
+	}
+	return nil
+}
+
+// printCertificate prints the fields relevant to the tunnel
+func printCertificate(cert *x509.Certificate, idx *common.Index) {
+	fingerprint := sha256.Sum256(cert.Raw)
+	serial := cert.SerialNumber.Text(16)
+
+	fmt.Printf("Subject:      %s\n", cert.Subject)
+	fmt.Printf("Issuer:       %s\n", cert.Issuer)
+	fmt.Printf("Serial:       %s\n", serial)
+	fmt.Printf("Valid:        %s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("Key:          %s\n", common.DescribeKey(cert.PublicKey))
+	fmt.Printf("Signature:    %s\n", cert.SignatureAlgorithm)
+	fmt.Printf("CA:           %t\n", cert.IsCA)
+	if len(cert.DNSNames) > 0 {
+		fmt.Printf("DNS names:    %s\n", strings.Join(cert.DNSNames, ", "))
+	}
+	for _, ip := range cert.IPAddresses {
+		fmt.Printf("IP address:   %s\n", ip)
+	}
+	for _, u := range cert.URIs {
+		if common.IsSPIFFEID(u.String()) {
+			fmt.Printf("SPIFFE ID:    %s\n", u)
+		} else {
+			fmt.Printf("URI:          %s\n", u)
+		}
+	}
+	fmt.Printf("SHA-256:      %s\n", hex.EncodeToString(fingerprint[:]))
+	fmt.Printf("SPKI pin:     %s\n", common.SPKIPin(cert))
+	if e, err := idx.Find(serial, ""); err == nil {
+		fmt.Printf("Status:       %s\n", e.Status(time.Now()))
+	}
+	fmt.Println()
+}
@@ -1,105 +1,141 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
 	"log"
-	"math/big"
-	"net"
 	"os"
 	"regexp"
 	"strings"
 	"time"
+
+	"z44-tunnel/common"
 )
 
-func main() {
-	// Get & Validate Input
-	serverAddr := strings.TrimSpace(os.Getenv("SERVER_ADDR"))
-	if serverAddr == "" {
-		log.Fatal("❌ Usage: SERVER_ADDR=your_ip_or_domain go run gen_certs.go")
-	}
+// Defaults
+const (
+	defaultDir              = "certs"
+	defaultCAName           = "Z44 Tunnel CA"
+	defaultIntermediate     = "Z44 Tunnel Intermediate CA"
+	defaultClientName       = "client"
+	defaultValidityDays     = 3650 // 10 Years
+	defaultIntermediateDays = 1825 // 5 Years
+	defaultTokenTTL         = 24 * time.Hour
+)
 
-	var ipAddresses []net.IP
-	var dnsNames []string
-
-	// Check if IP or Domain
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		fmt.Printf("🔒 Generating certs for IP: %s\n", ip)
-		// Add 127.0.0.1 for local testing, and the Server IP
-		ipAddresses = []net.IP{net.ParseIP("127.0.0.1"), ip}
-	} else {
-		if !isValidDomain(serverAddr) {
-			log.Fatalf("❌ Invalid domain or IP: %s", serverAddr)
-		}
-		fmt.Printf("🔒 Generating certs for Domain: %s\n", serverAddr)
-		ipAddresses = []net.IP{net.ParseIP("127.0.0.1")}
-		dnsNames = []string{serverAddr}
+// Default passphrase sources of encrypted CA keys, only read when a key is encrypted
+const (
+	defaultCAPassphrase   = "env:Z44_CA_PASSPHRASE"
+	defaultRootPassphrase = "env:Z44_ROOT_PASSPHRASE"
+)
+
+// keyAlgorithmUsage documents the --key flag
+var keyAlgorithmUsage = "key algorithm: " + strings.Join(common.KeyAlgorithms, ", ")
+
+// passphraseUsage documents the passphrase source flags
+const passphraseUsage = "file:/path, env:NAME or credential:NAME"
+
+// openStore opens a certificate store whose CA key may be encrypted
+func openStore(dir, passphraseSpec string) (*common.CertStore, error) {
+	passphrase, err := common.ParsePassphrase(passphraseSpec)
+	if err != nil {
+		return nil, err
 	}
+	store := common.NewCertStore(dir)
+	store.SetPassphrase(passphrase)
+	return store, nil
+}
+
+// usage describes the available subcommands
+const usage = `Usage: go run ./utils <command> [flags]
+
+Commands:
+  init-ca        Create the private CA (certs/ca.pem, certs/ca-key.pem)
+  init-intermediate
+                 Create an intermediate CA signed by an offline root (--root /mnt/root-ca)
+  issue-server   Issue the server certificate (--addr ip_or_domain[,...])
+  issue-client   Issue a client certificate (--name site-a [--uri urn:z44:site-a | spiffe://z44/site/site-a])
+  issue-token    Create a one-time enrollment token for a new client (--name site-a)
+  auth-token     Create a token a client authenticates with instead of a certificate (--name site-a)
+  list           List issued certificates
+  revoke         Revoke a certificate (--serial or --name) and update certs/crl.pem
+  renew          Re-issue a certificate with the same identity (--serial or --name)
+  inspect        Show the details of a certificate file
+
+Run "go run ./utils <command> -h" for the flags of a command.
+init-ca, init-intermediate, issue-server and issue-client accept --key (default rsa2048):
+rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519.
+They also accept --passphrase file:/path, env:NAME or credential:NAME to encrypt
+the new key. An encrypted CA key is decrypted with --ca-passphrase, by default
+from the Z44_CA_PASSPHRASE environment variable.
 
-	// Create Certificate Authority (CA)
-	ca := &x509.Certificate{
-		SerialNumber:          big.NewInt(2026),
-		Subject:               pkix.Name{CommonName: "Z44 Tunnel CA"},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0), // 10 Years
-		IsCA:                  true,
-		BasicConstraintsValid: true,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+Without a command, SERVER_ADDR=your_ip_or_domain go run ./utils creates the CA
+if missing, then issues the server certificate and a client certificate into certs/.`
+
+func main() {
+	if len(os.Args) < 2 {
+		quickstart()
+		return
 	}
-	caPrivKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	caBytes, _ := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
-
-	// Create Server Certificate
-	serverCert := &x509.Certificate{
-		SerialNumber: big.NewInt(2027),
-		Subject:      pkix.Name{CommonName: "Z44 Tunnel Server"},
-		IPAddresses:  ipAddresses,
-		DNSNames:     dnsNames,
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "init-ca":
+		err = cmdInitCA(args)
+	case "init-intermediate":
+		err = cmdInitIntermediate(args)
+	case "issue-server":
+		err = cmdIssueServer(args)
+	case "issue-client":
+		err = cmdIssueClient(args)
+	case "issue-token":
+		err = cmdIssueToken(args)
+	case "auth-token":
+		err = cmdAuthToken(args)
+	case "list":
+		err = cmdList(args)
+	case "revoke":
+		err = cmdRevoke(args)
+	case "renew":
+		err = cmdRenew(args)
+	case "inspect":
+		err = cmdInspect(args)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
 	}
-	serverPrivKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	serverBytes, _ := x509.CreateCertificate(rand.Reader, serverCert, ca, &serverPrivKey.PublicKey, caPrivKey)
-
-	// Create Client Certificate
-	clientCert := &x509.Certificate{
-		SerialNumber: big.NewInt(2028),
-		Subject:      pkix.Name{CommonName: "Z44 Tunnel Client"},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	if err != nil {
+		log.Fatalf("❌ %s: %v", cmd, err)
 	}
-	clientPrivKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	clientBytes, _ := x509.CreateCertificate(rand.Reader, clientCert, ca, &clientPrivKey.PublicKey, caPrivKey)
+}
 
-	// Write Files
-	if err := os.MkdirAll("certs", 0755); err != nil {
-		log.Fatal(err)
+// quickstart keeps the original one-shot behavior, but reuses an existing CA
+func quickstart() {
+	serverAddr := strings.TrimSpace(os.Getenv("SERVER_ADDR"))
+	if serverAddr == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	writePem("certs/ca.pem", "CERTIFICATE", caBytes)
-	writePem("certs/server-cert.pem", "CERTIFICATE", serverBytes)
-	writePem("certs/server-key.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(serverPrivKey))
-	writePem("certs/client-cert.pem", "CERTIFICATE", clientBytes)
-	writePem("certs/client-key.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(clientPrivKey))
-
-	fmt.Println("✅ Certificates created in 'certs/' folder.")
-}
-
-func writePem(filename, typeStr string, bytes []byte) {
-	f, err := os.Create(filename)
+	store, err := openStore(defaultDir, defaultCAPassphrase)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("❌ %v", err)
+	}
+	if !store.HasCA() {
+		if err := store.InitCA(defaultCAName, common.DefaultKeyAlgorithm, defaultValidityDays); err != nil {
+			log.Fatalf("❌ init-ca: %v", err)
+		}
 	}
-	defer f.Close()
-	pem.Encode(f, &pem.Block{Type: typeStr, Bytes: bytes})
+	if err := issueServer(store, serverAddr, common.DefaultKeyAlgorithm, store.Dir(), defaultValidityDays, nil); err != nil {
+		log.Fatalf("❌ issue-server: %v", err)
+	}
+	if err := issueClient(store, defaultClientName, "", common.DefaultKeyAlgorithm, store.Dir(), defaultValidityDays, true, nil); err != nil {
+		log.Fatalf("❌ issue-client: %v", err)
+	}
+
+	fmt.Printf("✅ Certificates created in '%s/' folder.\n", store.Dir())
 }
 
 func isValidDomain(domain string) bool {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"z44-tunnel/common"
+)
+
+// issueServer issues the server certificate for one or more comma separated addresses
+// passphrase optionally encrypts the new key
+func issueServer(store *common.CertStore, addrs, keyAlgorithm, outDir string, days int, passphrase common.Passphrase) error {
+	// Add 127.0.0.1 for local testing
+	ipAddresses := []net.IP{net.ParseIP("127.0.0.1")}
+	var dnsNames []string
+
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if ip := net.ParseIP(addr); ip != nil {
+			fmt.Printf("🔒 Issuing server cert for IP: %s\n", ip)
+			ipAddresses = append(ipAddresses, ip)
+			continue
+		}
+		if !isValidDomain(addr) {
+			return fmt.Errorf("invalid domain or IP: %s", addr)
+		}
+		fmt.Printf("🔒 Issuing server cert for Domain: %s\n", addr)
+		dnsNames = append(dnsNames, addr)
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "Z44 Tunnel Server"},
+		IPAddresses: ipAddresses,
+		DNSNames:    dnsNames,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	key, err := common.GenerateKey(keyAlgorithm)
+	if err != nil {
+		return err
+	}
+	if err := issue(store, nil, common.CertTypeServer, "server", template, key, outDir, "server", days, passphrase); err != nil {
+		return err
+	}
+
+	pin, err := common.PublicKeyPin(key.Public())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("📌 Server key pin for the client's server_pins: %s\n", pin)
+	return nil
+}
+
+// issueClient issues a client certificate named after the client
+// uri optionally adds a URI SAN, which the server prefers over the CN as identity
+// force replaces an active certificate with the same name
+// passphrase optionally encrypts the new key
+func issueClient(store *common.CertStore, name, uri, keyAlgorithm, outDir string, days int, force bool, passphrase common.Passphrase) error {
+	template, err := common.ClientTemplate(name, uri)
+	if err != nil {
+		return err
+	}
+
+	if uri != "" {
+		fmt.Printf("🔒 Issuing client cert for: %s (%s)\n", name, uri)
+	} else {
+		fmt.Printf("🔒 Issuing client cert for: %s\n", name)
+	}
+	key, err := common.GenerateKey(keyAlgorithm)
+	if err != nil {
+		return err
+	}
+	unique := func(idx *common.Index) error {
+		if e, err := idx.Find("", name); err == nil && e.Type == common.CertTypeClient && !force {
+			return fmt.Errorf("client '%s' already has certificate %s, renew or revoke it instead", name, e.Serial)
+		}
+		return nil
+	}
+	if err := issue(store, unique, common.CertTypeClient, name, template, key, outDir, "client", days, passphrase); err != nil {
+		return err
+	}
+
+	// Ship the CA next to the client certificate so the folder is a complete bundle
+	if filepath.Clean(outDir) != filepath.Clean(store.Dir()) {
+		caPem, err := os.ReadFile(store.Path("ca.pem"))
+		if err != nil {
+			return err
+		}
+		return common.WriteFileAtomic(filepath.Join(outDir, "ca.pem"), caPem, 0644)
+	}
+	return nil
+}
+
+// issue signs a certificate, writes it with its key and records it in the index
+// check, if set, vets the index first; both run under the store lock so
+// concurrent runs cannot both pass it
+// prefix names the "<prefix>-cert.pem" and "<prefix>-key.pem" files
+func issue(store *common.CertStore, check func(*common.Index) error, certType, name string, template *x509.Certificate, key crypto.Signer, outDir, prefix string, days int, passphrase common.Passphrase) error {
+	certFile := filepath.Join(outDir, prefix+"-cert.pem")
+	keyFile := filepath.Join(outDir, prefix+"-key.pem")
+	err := store.UpdateIndex(func(idx *common.Index) error {
+		if check != nil {
+			if err := check(idx); err != nil {
+				return err
+			}
+		}
+		certBytes, err := store.Sign(template, key.Public(), days)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(outDir, 0700); err != nil {
+			return err
+		}
+		if err := common.WriteKey(keyFile, key, passphrase); err != nil {
+			return err
+		}
+		chain, err := store.EncodeChain(certBytes)
+		if err != nil {
+			return err
+		}
+		if err := common.WriteFileAtomic(certFile, chain, 0644); err != nil {
+			return err
+		}
+
+		idx.Add(common.IndexEntry{
+			Serial:   template.SerialNumber.Text(16),
+			Type:     certType,
+			Name:     name,
+			NotAfter: template.NotAfter,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		}, "")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Issued %s certificate %s (serial %s, expires %s)\n",
+		certType, certFile, template.SerialNumber.Text(16), template.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// renew re-issues a certificate with the same identity and key
+// days of zero keeps the validity period of the old certificate
+// passphrase decrypts an encrypted key, which is written back encrypted
+func renew(store *common.CertStore, entry common.IndexEntry, days int, passphrase common.Passphrase) error {
+	pair, err := common.LoadCertKeyPair(entry.CertFile, common.FileKey(entry.KeyFile, passphrase))
+	if err != nil {
+		return fmt.Errorf("failed to load certificate to renew: %w", err)
+	}
+	old, key := pair.Leaf, pair.PrivateKey.(crypto.Signer)
+
+	if days == 0 {
+		days = int(math.Round(old.NotAfter.Sub(old.NotBefore).Hours() / 24))
+	}
+
+	template := &x509.Certificate{
+		Subject:     old.Subject,
+		IPAddresses: old.IPAddresses,
+		DNSNames:    old.DNSNames,
+		URIs:        old.URIs,
+		ExtKeyUsage: old.ExtKeyUsage,
+	}
+	outDir := filepath.Dir(entry.CertFile)
+	prefix := strings.TrimSuffix(filepath.Base(entry.CertFile), "-cert.pem")
+	return issue(store, stillActive(entry.Serial), entry.Type, entry.Name, template, key, outDir, prefix, days, passphrase)
+}
+
+// stillActive refuses a certificate that was renewed or revoked since it
+// was looked up
+func stillActive(serial string) func(*common.Index) error {
+	return func(idx *common.Index) error {
+		e, err := idx.Find(serial, "")
+		if err != nil {
+			return err
+		}
+		if !e.Active() {
+			return fmt.Errorf("certificate %s is %s", serial, e.Status(time.Now()))
+		}
+		return nil
+	}
+}